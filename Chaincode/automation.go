@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// manualSource stands in for the installedSmartAppId of changes made by
+// hand at the device, which SmartThings reports as isPhysical.
+const manualSource = "manual"
+
+// automationStats counts the events one SmartApp, or manual operation,
+// caused on one device. Values counts the events per reported value, e.g.
+// how often a switch was turned on. automationSummary adds it up from
+// automation events; locations that logged before those were recorded
+// also have one stored under the automation composite key of locationId,
+// source and deviceId, counting the events until then.
+type automationStats struct {
+	DocType             string                    `json:"docType"`
+	LocationID          string                    `json:"locationId"`
+	InstalledSmartAppID string                    `json:"installedSmartAppId"`
+	DeviceID            string                    `json:"deviceId"`
+	DisplayName         string                    `json:"displayName"`
+	Events              int                       `json:"events"`
+	Values              map[string]map[string]int `json:"values"`
+	First               string                    `json:"first"`
+	Last                string                    `json:"last"`
+}
+
+// automationEvent is one event a SmartApp, or manual operation, caused,
+// stored under the automation composite key of locationId, source,
+// deviceId, time and capability. Events that hide their source and value
+// are recorded under an empty source with Hidden set and EventKey pointing
+// to the event.
+type automationEvent struct {
+	DocType             string `json:"docType"`
+	LocationID          string `json:"locationId"`
+	InstalledSmartAppID string `json:"installedSmartAppId"`
+	DeviceID            string `json:"deviceId"`
+	Name                string `json:"name"`
+	Value               string `json:"value"`
+	Time                string `json:"time"`
+	Hidden              bool   `json:"hidden,omitempty"`
+	EventKey            string `json:"eventKey,omitempty"`
+}
+
+// automationSource is the summary of one SmartApp, or of manual operation,
+// across the devices it changed.
+type automationSource struct {
+	InstalledSmartAppID string             `json:"installedSmartAppId"`
+	Manual              bool               `json:"manual"`
+	Events              int                `json:"events"`
+	First               string             `json:"first"`
+	Last                string             `json:"last"`
+	Devices             []*automationStats `json:"devices"`
+}
+
+// noSmartApp lists the installedSmartAppId values of events no SmartApp
+// sent.
+var noSmartApp = []string{"", "null"}
+
+// eventSource returns who caused an event: the SmartApp that sent it,
+// manualSource for physical changes or "" when neither is known. A
+// SmartApp that sends a physical event, such as one acting on a button
+// press, is credited with it; queryByAutomation selects events by the
+// same rule.
+func eventSource(e event) string {
+	for _, none := range noSmartApp {
+		if e.InstalledSmartAppID == none {
+			if e.IsPhysical == "true" {
+				return manualSource
+			}
+			return ""
+		}
+	}
+	return e.InstalledSmartAppID
+}
+
+// recordAutomation is called by saveNewEvent to record the event against
+// the SmartApp that caused it, or as a manual change. Each event gets a
+// key of its own and is written without reading anything, so events of
+// one device in the same block do not conflict. When hidden is set the
+// stored event hides its source, and every event is recorded so the
+// records do not tell which had one.
+func recordAutomation(stub shim.ChaincodeStubInterface, eventKey string, e event, hidden bool) error {
+	record := automationEvent{
+		DocType:             "AutomationEvent",
+		LocationID:          e.LocationID,
+		InstalledSmartAppID: eventSource(e),
+		DeviceID:            e.DeviceID,
+		Name:                e.Name,
+		Value:               e.Value,
+		Time:                e.Time,
+	}
+	if hidden {
+		record.InstalledSmartAppID, record.Value, record.Hidden, record.EventKey = "", "", true, eventKey
+	} else if record.InstalledSmartAppID == "" {
+		return nil
+	}
+	key, err := stub.CreateCompositeKey("automation", []string{e.LocationID, record.InstalledSmartAppID, e.DeviceID, e.Time, e.Name})
+	if err != nil {
+		return err
+	}
+	return putStateJSON(stub, key, record)
+}
+
+// add counts an automation event.
+func (stats *automationStats) add(e automationEvent) {
+	stats.Events++
+	if stats.Values[e.Name] == nil {
+		stats.Values[e.Name] = map[string]int{}
+	}
+	stats.Values[e.Name][e.Value]++
+	if stats.First == "" || e.Time < stats.First {
+		stats.First = e.Time
+	}
+	if e.Time > stats.Last {
+		stats.Last = e.Time
+	}
+}
+
+// merge adds the counts of other, for the same source and device.
+func (stats *automationStats) merge(other automationStats) {
+	stats.DisplayName = other.DisplayName
+	stats.Events += other.Events
+	for name, values := range other.Values {
+		if stats.Values[name] == nil {
+			stats.Values[name] = map[string]int{}
+		}
+		for value, n := range values {
+			stats.Values[name][value] += n
+		}
+	}
+	if other.First != "" && (stats.First == "" || other.First < stats.First) {
+		stats.First = other.First
+	}
+	if other.Last > stats.Last {
+		stats.Last = other.Last
+	}
+}
+
+// queryByAutomation returns the events a SmartApp caused at a location
+// between two times. Passing "manual" as the installedSmartAppId returns
+// the changes made by hand that no SmartApp sent instead.
+// Args: locationId, installedSmartAppId, from, to, then optionally pageSize
+// and bookmark.
+func (t *SimpleAsset) queryByAutomation(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) < 4 || len(args) > 6 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId, installedSmartAppId, from, to and optionally pageSize, bookmark")
+	}
+
+	locationId := args[0]
+	source := strings.ToLower(args[1])
+	from, err := normalizeTime(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := normalizeTime(args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	pageSize := defaultPageSize
+	if len(args) > 4 {
+		if pageSize, err = parsePageSize(args[4]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	var bookmark pageBookmark
+	if len(args) > 5 {
+		if bookmark, err = decodeBookmark(args[5]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if bookmark.Time > from {
+		from = bookmark.Time
+	}
+
+	private, err := keepsDetailsPrivate(stub, locationId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var queryString string
+	var filters []queryFilter
+	switch {
+	case source == manualSource:
+		filters = []queryFilter{{field: "isPhysical", value: "true", hidden: true}, {field: "installedSmartAppId", in: noSmartApp, hidden: true}}
+		queryString = timelineQuery.rangeQueryString([]string{locationId}, from, to, filters, nil)
+	case private:
+		// Events keeping their source private are not found by the
+		// automation index.
+		filters = []queryFilter{{field: "installedSmartAppId", value: source, hidden: true}}
+		queryString = timelineQuery.rangeQueryString([]string{locationId}, from, to, filters, nil)
+	default:
+		queryString = automationQuery.rangeQueryString([]string{locationId, source}, from, to, nil, nil)
+	}
+
+	queryResults, err := getQueryResultPage(stub, queryString, filters, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+// automationSummary lists every SmartApp that changed devices at a
+// location, and the manual changes, with how often each device was changed
+// and to which values, busiest source first.
+// Args: locationId.
+func (t *SimpleAsset) automationSummary(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("automation", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	// Keys come back ordered by source, then device, except for the events
+	// that hide their source, which are filled in from their event as far
+	// as the caller may read it.
+	details := newDetailsReader(stub)
+	summary := []*automationSource{}
+	sources := map[string]*automationSource{}
+	byDevice := map[string]*automationStats{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var record struct {
+			automationStats
+			Name     string `json:"name"`
+			Value    string `json:"value"`
+			Time     string `json:"time"`
+			Hidden   bool   `json:"hidden"`
+			EventKey string `json:"eventKey"`
+		}
+		if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+			return shim.Error(err.Error())
+		}
+		if record.Hidden {
+			e, ok, err := details.event(record.EventKey)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if record.InstalledSmartAppID = eventSource(e); !ok || record.InstalledSmartAppID == "" {
+				continue
+			}
+			record.Value = e.Value
+		}
+		current := sources[record.InstalledSmartAppID]
+		if current == nil {
+			current = &automationSource{
+				InstalledSmartAppID: record.InstalledSmartAppID,
+				Manual:              record.InstalledSmartAppID == manualSource,
+			}
+			sources[current.InstalledSmartAppID] = current
+			summary = append(summary, current)
+		}
+		stats := byDevice[record.InstalledSmartAppID+"\x00"+record.DeviceID]
+		if stats == nil {
+			stats = &automationStats{
+				DocType:             "AutomationStats",
+				LocationID:          args[0],
+				InstalledSmartAppID: record.InstalledSmartAppID,
+				DeviceID:            record.DeviceID,
+				Values:              map[string]map[string]int{},
+			}
+			byDevice[record.InstalledSmartAppID+"\x00"+record.DeviceID] = stats
+			current.Devices = append(current.Devices, stats)
+		}
+		if record.DocType == "AutomationStats" {
+			stats.merge(record.automationStats)
+		} else {
+			stats.add(automationEvent{Name: record.Name, Value: record.Value, Time: record.Time})
+		}
+	}
+	for _, source := range summary {
+		for _, device := range source.Devices {
+			source.Events += device.Events
+			if source.First == "" || device.First < source.First {
+				source.First = device.First
+			}
+			if device.Last > source.Last {
+				source.Last = device.Last
+			}
+			var latest eventLess
+			found, err := getStateJSON(stub, device.DeviceID, &latest)
+			if err == nil {
+				err = details.revealLatest(&latest)
+			}
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if found && latest.LocationID == args[0] {
+				device.DisplayName = latest.DisplayName
+			}
+		}
+	}
+	for _, source := range summary {
+		devices := source.Devices
+		sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+		sort.SliceStable(devices, func(i, j int) bool { return devices[i].Events > devices[j].Events })
+	}
+	sort.Slice(summary, func(i, j int) bool { return summary[i].InstalledSmartAppID < summary[j].InstalledSmartAppID })
+	sort.SliceStable(summary, func(i, j int) bool { return summary[i].Events > summary[j].Events })
+
+	return successJSON(summary)
+}
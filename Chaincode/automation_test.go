@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestEventSource(t *testing.T) {
+	tests := []struct {
+		name string
+		e    event
+		want string
+	}{
+		{"app", event{InstalledSmartAppID: "app1", IsDigital: "true"}, "app1"},
+		{"physical from an app", event{InstalledSmartAppID: "app1", IsPhysical: "true"}, "app1"},
+		{"by hand", event{InstalledSmartAppID: "null", IsPhysical: "true"}, manualSource},
+		{"by hand without app id", event{IsPhysical: "true"}, manualSource},
+		{"unknown", event{InstalledSmartAppID: "null", IsDigital: "true"}, ""},
+	}
+	for _, tt := range tests {
+		if got := eventSource(tt.e); got != tt.want {
+			t.Errorf("%s: eventSource = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAutomationStatsCount(t *testing.T) {
+	stats := automationStats{Values: map[string]map[string]int{}}
+	stats.merge(automationStats{DisplayName: "Lamp", Events: 2, Values: map[string]map[string]int{"switch": {"on": 2}}, First: "2018-08-14t08:00:00.000z", Last: "2018-08-14t20:00:00.000z"})
+	stats.add(automationEvent{Name: "switch", Value: "on", Time: "2018-08-15t08:00:00.000z"})
+	stats.add(automationEvent{Name: "switch", Value: "off", Time: "2018-08-15t07:00:00.000z"})
+	stats.add(automationEvent{Name: "level", Value: "40", Time: "2018-08-15t09:00:00.000z"})
+
+	if stats.Events != 5 || stats.Values["switch"]["on"] != 3 || stats.Values["switch"]["off"] != 1 || stats.Values["level"]["40"] != 1 {
+		t.Errorf("counts = %d, %v", stats.Events, stats.Values)
+	}
+	if stats.First != "2018-08-14t08:00:00.000z" || stats.Last != "2018-08-15t09:00:00.000z" || stats.DisplayName != "Lamp" {
+		t.Errorf("stats = %+v", stats)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	// batteryReplacedRise is how far the level has to rise between two
+	// readings to count as a new battery; the drain rate is only estimated
+	// from readings since then.
+	batteryReplacedRise = 10
+	// batteryForecastWindow limits the readings used for the drain rate.
+	batteryForecastWindow = 90 * 24 * time.Hour
+	// minForecastSpan is the least time the readings have to cover.
+	minForecastSpan = 24 * time.Hour
+)
+
+// batteryReading is one battery level report, stored under the battery
+// composite key of deviceId and time.
+type batteryReading struct {
+	DocType    string  `json:"docType"`
+	DeviceID   string  `json:"deviceId"`
+	LocationID string  `json:"locationId"`
+	Level      float64 `json:"level"`
+	Time       string  `json:"time"`
+	Hidden     bool    `json:"hidden,omitempty"`
+	EventKey   string  `json:"eventKey,omitempty"`
+}
+
+// batteryForecast is the drain rate estimated from a device's battery
+// history. DaysLeft is only set when the level is falling.
+type batteryForecast struct {
+	DeviceID       string   `json:"deviceId"`
+	DisplayName    string   `json:"displayName"`
+	Level          float64  `json:"level"`
+	Time           string   `json:"time"`
+	Readings       int      `json:"readings"`
+	DrainPerDay    *float64 `json:"drainPerDay,omitempty"`
+	DaysLeft       *float64 `json:"daysLeft,omitempty"`
+	ProjectedEmpty string   `json:"projectedEmpty,omitempty"`
+}
+
+// recordBattery is called by saveNewEvent for every stored event and keeps
+// the battery history of the device for battery events. Each reading gets
+// a key of its own and is written without reading anything, so battery
+// events of one device in the same block do not conflict; the latest
+// level is the last reading. When hidden is set the stored event hides its
+// value, and the reading leaves the level out and points to the event.
+func recordBattery(stub shim.ChaincodeStubInterface, eventKey string, e event, hidden bool) error {
+	if e.Name != "battery" {
+		return nil
+	}
+	level, err := strconv.ParseFloat(e.Value, 64)
+	if err != nil {
+		return nil
+	}
+
+	key, err := stub.CreateCompositeKey("battery", []string{e.DeviceID, e.Time})
+	if err != nil {
+		return err
+	}
+	reading := batteryReading{DocType: "BatteryReading", DeviceID: e.DeviceID, LocationID: e.LocationID, Level: level, Time: e.Time}
+	if hidden {
+		reading.Level, reading.Hidden, reading.EventKey = 0, true, eventKey
+	}
+	return putStateJSON(stub, key, reading)
+}
+
+// getBatteryReadings returns the battery readings of a device in time
+// order. Readings whose event the caller may not read are left out.
+func getBatteryReadings(stub shim.ChaincodeStubInterface, deviceID string) ([]batteryReading, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("battery", []string{deviceID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	details := newDetailsReader(stub)
+	var readings []batteryReading
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var reading batteryReading
+		if err := json.Unmarshal(queryResponse.Value, &reading); err != nil {
+			return nil, err
+		}
+		if reading.Hidden {
+			e, ok, err := details.event(reading.EventKey)
+			if err != nil {
+				return nil, err
+			}
+			level, err := strconv.ParseFloat(e.Value, 64)
+			if !ok || err != nil {
+				continue
+			}
+			reading.Level = level
+		}
+		readings = append(readings, reading)
+	}
+	return readings, nil
+}
+
+// forecastBattery estimates how fast a device's battery drains with a
+// least squares fit over its readings since the battery was last replaced,
+// and when it will be empty. The readings have to be in time order, and
+// there has to be at least one.
+func forecastBattery(deviceID, displayName string, readings []batteryReading) batteryForecast {
+	latest := readings[len(readings)-1]
+	forecast := batteryForecast{DeviceID: deviceID, DisplayName: displayName, Level: latest.Level, Time: latest.Time}
+
+	last, err := parseEventTime(latest.Time)
+	if err != nil {
+		return forecast
+	}
+	drain, used, ok := drainRate(sinceReplaced(readings), last)
+	forecast.Readings = used
+	if !ok {
+		return forecast
+	}
+	forecast.DrainPerDay = &drain
+	if drain > 0 {
+		daysLeft := latest.Level / drain
+		forecast.DaysLeft = &daysLeft
+		forecast.ProjectedEmpty = last.Add(time.Duration(daysLeft * 24 * float64(time.Hour))).Format(eventTimeLayout)
+	}
+	return forecast
+}
+
+// sinceReplaced returns the readings, in time order, taken since the
+// battery was last replaced.
+func sinceReplaced(readings []batteryReading) []batteryReading {
+	for i := len(readings) - 1; i > 0; i-- {
+		if readings[i].Level-readings[i-1].Level >= batteryReplacedRise {
+			return readings[i:]
+		}
+	}
+	return readings
+}
+
+// drainRate fits a line through the battery readings within the forecast
+// window before last and returns the level lost per day, with the number of
+// readings used. ok is false when the readings cover too short a time for
+// an estimate.
+func drainRate(readings []batteryReading, last time.Time) (drain float64, used int, ok bool) {
+	var xs, ys []float64
+	for _, reading := range readings {
+		at, err := parseEventTime(reading.Time)
+		if err != nil || last.Sub(at) > batteryForecastWindow {
+			continue
+		}
+		xs = append(xs, at.Sub(last).Hours()/24)
+		ys = append(ys, reading.Level)
+	}
+	if len(xs) < 2 || xs[len(xs)-1]-xs[0] < minForecastSpan.Hours()/24 {
+		return 0, len(xs), false
+	}
+
+	var sumX, sumY, sumXY, sumXX float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+		sumXY += xs[i] * ys[i]
+		sumXX += xs[i] * xs[i]
+	}
+	n := float64(len(xs))
+	slope := (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+	return -slope, len(xs), true
+}
+
+// queryLowBatteries lists the devices of a location whose latest battery
+// level is at or below a threshold, lowest first, with their drain rate.
+// Args: locationId, threshold in percent.
+func (t *SimpleAsset) queryLowBatteries(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and threshold")
+	}
+
+	threshold, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("invalid threshold %q", args[1]))
+	}
+
+	devices, err := getLocationDevices(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	low := []batteryForecast{}
+	for _, device := range devices {
+		readings, err := getBatteryReadings(stub, device.DeviceID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(readings) == 0 || readings[len(readings)-1].Level > threshold {
+			continue
+		}
+		low = append(low, forecastBattery(device.DeviceID, device.Latest.DisplayName, readings))
+	}
+	sort.SliceStable(low, func(i, j int) bool {
+		if low[i].Level != low[j].Level {
+			return low[i].Level < low[j].Level
+		}
+		return low[i].DeviceID < low[j].DeviceID
+	})
+
+	return successJSON(low)
+}
+
+// batteryDrain returns the battery level and drain rate of a device.
+// Args: deviceId.
+func (t *SimpleAsset) batteryDrain(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting deviceId")
+	}
+
+	readings, err := getBatteryReadings(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(readings) == 0 {
+		return shim.Error("no battery readings for device")
+	}
+	var latest eventLess
+	if _, err := getStateJSON(stub, args[0], &latest); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := newDetailsReader(stub).revealLatest(&latest); err != nil {
+		return shim.Error(err.Error())
+	}
+	forecast := forecastBattery(args[0], latest.DisplayName, readings)
+	return successJSON(forecast)
+}
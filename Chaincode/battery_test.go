@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func batteryReadings(levels ...float64) []batteryReading {
+	readings := make([]batteryReading, len(levels))
+	start := time.Date(2018, 8, 1, 0, 0, 0, 0, time.UTC)
+	for i, level := range levels {
+		readings[i] = batteryReading{Level: level, Time: start.AddDate(0, 0, i).Format(eventTimeLayout)}
+	}
+	return readings
+}
+
+func TestSinceReplaced(t *testing.T) {
+	tests := []struct {
+		levels []float64
+		want   int
+	}{
+		{[]float64{90, 88, 86}, 3},
+		{[]float64{20, 15, 100, 99}, 2},
+		{[]float64{50, 40, 45, 44}, 4},
+		{[]float64{30, 100, 20, 100, 98}, 2},
+		{nil, 0},
+	}
+	for _, tt := range tests {
+		if got := sinceReplaced(batteryReadings(tt.levels...)); len(got) != tt.want {
+			t.Errorf("sinceReplaced(%v) kept %d readings, want %d", tt.levels, len(got), tt.want)
+		}
+	}
+}
+
+func TestDrainRate(t *testing.T) {
+	last := time.Date(2018, 8, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		levels []float64
+		drain  float64
+		ok     bool
+	}{
+		{"steady", []float64{90, 88, 86, 84}, 2, true},
+		{"flat", []float64{70, 70, 70}, 0, true},
+		{"rising", []float64{50, 51, 52}, -1, true},
+		{"one reading", []float64{90}, 0, false},
+	}
+	for _, tt := range tests {
+		readings := batteryReadings(tt.levels...)
+		end := last.AddDate(0, 0, len(readings)-1)
+		drain, used, ok := drainRate(readings, end)
+		if ok != tt.ok || used != len(readings) || (ok && math.Abs(drain-tt.drain) > 1e-9) {
+			t.Errorf("%s: drainRate = %v, %d, %v", tt.name, drain, used, ok)
+		}
+	}
+
+	// Readings less than a day apart are too close for an estimate.
+	halfDay := []batteryReading{
+		{Level: 90, Time: "2018-08-01t00:00:00.000z"},
+		{Level: 80, Time: "2018-08-01t12:00:00.000z"},
+	}
+	if _, _, ok := drainRate(halfDay, last.Add(12*time.Hour)); ok {
+		t.Error("drainRate estimated from half a day of readings")
+	}
+	// Readings older than the forecast window are left out.
+	old := batteryReadings(90, 89)
+	if _, used, _ := drainRate(old, last.Add(batteryForecastWindow+48*time.Hour)); used != 0 {
+		t.Errorf("drainRate used %d readings outside the window", used)
+	}
+}
+
+func TestForecastBattery(t *testing.T) {
+	forecast := forecastBattery("device-1", "Motion Sensor", batteryReadings(20, 15, 100, 98, 96))
+	if forecast.Level != 96 || forecast.Time != "2018-08-05t00:00:00.000z" || forecast.Readings != 3 {
+		t.Fatalf("forecastBattery() = %+v", forecast)
+	}
+	if forecast.DrainPerDay == nil || math.Abs(*forecast.DrainPerDay-2) > 1e-9 {
+		t.Fatalf("drain per day = %v, want 2", forecast.DrainPerDay)
+	}
+	if forecast.DaysLeft == nil || math.Abs(*forecast.DaysLeft-48) > 1e-9 || forecast.ProjectedEmpty != "2018-09-22t00:00:00.000z" {
+		t.Errorf("days left = %v, empty at %s", forecast.DaysLeft, forecast.ProjectedEmpty)
+	}
+
+	// A single reading gives the level but no drain rate.
+	if forecast := forecastBattery("device-1", "", batteryReadings(50)); forecast.Level != 50 || forecast.DrainPerDay != nil {
+		t.Errorf("forecastBattery() of one reading = %+v", forecast)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// queryLocationByCapability returns the events of one capability (motion,
+// contact, lock, ...) across all devices of a location between two times.
+// Args: locationId, name, from, to, then optionally pageSize, bookmark, a
+// value to match, e.g. "active" for motion that fired, and a unit to
+// convert numeric readings to.
+func (t *SimpleAsset) queryLocationByCapability(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) < 4 || len(args) > 8 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId, name, from, to and optionally pageSize, bookmark, value, unit")
+	}
+
+	locationId := args[0]
+	name := strings.ToLower(args[1])
+	from, err := normalizeTime(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := normalizeTime(args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	pageSize := defaultPageSize
+	if len(args) > 4 {
+		if pageSize, err = parsePageSize(args[4]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	var bookmark pageBookmark
+	if len(args) > 5 {
+		if bookmark, err = decodeBookmark(args[5]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	var filters []queryFilter
+	if len(args) > 6 && args[6] != "" {
+		filters = append(filters, queryFilter{field: "value", value: strings.ToLower(args[6]), hidden: true})
+	}
+	var unit string
+	if len(args) > 7 {
+		if unit, err = parseOutputUnit(args[7]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	if bookmark.Time > from {
+		from = bookmark.Time
+	}
+	queryString := capabilityQuery.rangeQueryString([]string{locationId, name}, from, to, filters, nil)
+
+	queryResults, err := getQueryResultPage(stub, queryString, filters, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if queryResults, err = withOutputUnit(queryResults, unit); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
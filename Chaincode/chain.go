@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// chainHead is the newest link of a device's hash chain, stored under the
+// chainhead composite key of locationId and deviceId. Location events all
+// share the deviceId "null", so chains are kept per location to keep
+// households apart. Every saveNewEvent for a device reads and writes the
+// head, so concurrent events of one device are ordered by MVCC instead of
+// both claiming the same sequence number: of two events of a device
+// submitted into the same block, the second fails validation with
+// MVCC_READ_CONFLICT and has to be submitted again. Clients submit the
+// events of a device one at a time or retry them.
+type chainHead struct {
+	DocType  string `json:"docType"`
+	DeviceID string `json:"deviceId"`
+	Seq      int64  `json:"seq"`
+	Hash     string `json:"hash"`
+	EventKey string `json:"eventKey"`
+}
+
+// chainLink indexes a device's events by sequence number, stored under the
+// chain composite key of locationId, deviceId and the zero padded sequence
+// number. Hash is the hash of the event when it was stored.
+type chainLink struct {
+	DocType  string `json:"docType"`
+	DeviceID string `json:"deviceId"`
+	Seq      int64  `json:"seq"`
+	EventKey string `json:"eventKey"`
+	Hash     string `json:"hash"`
+}
+
+// chainIssue is a problem verifyDeviceChain found with one sequence number.
+// Kind is "missing" when the event is gone, "overwritten" when its key now
+// holds a different event, "modified" when its content no longer matches
+// its hash, "broken" when its prevHash does not match the event before it
+// and "duplicate" when two events claim the number.
+type chainIssue struct {
+	Seq    int64  `json:"seq"`
+	Key    string `json:"key,omitempty"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+// chainReport is the response of verifyDeviceChain. Unchained counts events
+// in the range stored before hash chains were introduced.
+type chainReport struct {
+	LocationID string       `json:"locationId"`
+	DeviceID   string       `json:"deviceId"`
+	From       string       `json:"from"`
+	To         string       `json:"to"`
+	Events     int          `json:"events"`
+	Unchained  int          `json:"unchained"`
+	FirstSeq   int64        `json:"firstSeq"`
+	LastSeq    int64        `json:"lastSeq"`
+	HeadSeq    int64        `json:"headSeq"`
+	Valid      bool         `json:"valid"`
+	Issues     []chainIssue `json:"issues"`
+}
+
+// canonicalField is one member of an event's canonical JSON.
+type canonicalField struct {
+	name  string
+	value interface{}
+}
+
+// canonicalFields lists the members of an event's canonical JSON in order.
+// This is version 1 of the canonical form, which chain hashes, day seals
+// and tombstones depend on: fields may only be appended to the list, and
+// only ones that are empty on every event stored before.
+func (e event) canonicalFields() []canonicalField {
+	return []canonicalField{
+		{"docType", e.DocType},
+		{"displayName", e.DisplayName},
+		{"device", e.Device},
+		{"isStateChange", e.IsStateChange},
+		{"id", e.ID},
+		{"description", e.Description},
+		{"descriptionText", e.DescriptionText},
+		{"installedSmartAppId", e.InstalledSmartAppID},
+		{"isDigital", e.IsDigital},
+		{"isPhysical", e.IsPhysical},
+		{"deviceId", e.DeviceID},
+		{"location", e.Location},
+		{"locationId", e.LocationID},
+		{"source", e.Source},
+		{"unit", e.Unit},
+		{"value", e.Value},
+		{"numericValue", e.NumericValue},
+		{"numericUnit", e.NumericUnit},
+		{"canonicalValue", e.CanonicalValue},
+		{"canonicalUnit", e.CanonicalUnit},
+		{"name", e.Name},
+		{"time", e.Time},
+		{"date", e.Date},
+		{"signedBy", e.SignedBy},
+		{"signatureStatus", e.SignatureStatus},
+		{"detailsCollection", e.DetailsCollection},
+		{"detailsHash", e.DetailsHash},
+		{"encryptionKeyId", e.EncryptionKeyID},
+		{"encryptedFields", e.EncryptedFields},
+		{"seq", e.Seq},
+		{"prevHash", e.PrevHash},
+	}
+}
+
+// canonicalJSON returns the event as a JSON object of its canonical fields
+// that are not empty, in canonical order. Hashes are taken over this form
+// rather than the bytes read back from the state database, which CouchDB
+// may reorder, or the marshalled struct, which changes as fields are added.
+func (e event) canonicalJSON() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, field := range e.canonicalFields() {
+		switch value := field.value.(type) {
+		case string:
+			if value == "" {
+				continue
+			}
+		case *float64:
+			if value == nil {
+				continue
+			}
+		case []string:
+			if len(value) == 0 {
+				continue
+			}
+		case int64:
+			if value == 0 {
+				continue
+			}
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(field.name)
+		value, _ := json.Marshal(field.value)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// hash returns the SHA-256 of the event's canonical JSON.
+func (e event) hash() string {
+	sum := sha256.Sum256(e.canonicalJSON())
+	return hex.EncodeToString(sum[:])
+}
+
+// chainKey returns the key of a device's chain link for a sequence number.
+func chainKey(stub shim.ChaincodeStubInterface, locationID, deviceID string, seq int64) (string, error) {
+	return stub.CreateCompositeKey("chain", []string{locationID, deviceID, fmt.Sprintf("%012d", seq)})
+}
+
+// chainHeadKey returns the key of a device's chain head.
+func chainHeadKey(stub shim.ChaincodeStubInterface, locationID, deviceID string) (string, error) {
+	return stub.CreateCompositeKey("chainhead", []string{locationID, deviceID})
+}
+
+// chainEvent is called by saveNewEvent before the event is stored. It gives
+// the event the next sequence number of its device and the hash of the
+// device's previous event, then moves the chain head to the event.
+func chainEvent(stub shim.ChaincodeStubInterface, eventKey string, e *event) error {
+	headKey, err := chainHeadKey(stub, e.LocationID, e.DeviceID)
+	if err != nil {
+		return err
+	}
+	var head chainHead
+	if _, err := getStateJSON(stub, headKey, &head); err != nil {
+		return err
+	}
+	e.Seq = head.Seq + 1
+	e.PrevHash = head.Hash
+
+	link := chainLink{DocType: "ChainLink", DeviceID: e.DeviceID, Seq: e.Seq, EventKey: eventKey, Hash: e.hash()}
+	linkKey, err := chainKey(stub, e.LocationID, e.DeviceID, e.Seq)
+	if err != nil {
+		return err
+	}
+	if err := putStateJSON(stub, linkKey, link); err != nil {
+		return err
+	}
+	head = chainHead{DocType: "ChainHead", DeviceID: e.DeviceID, Seq: e.Seq, Hash: link.Hash, EventKey: eventKey}
+	return putStateJSON(stub, headKey, head)
+}
+
+// chainEntry is an event as found on the ledger while verifying a chain.
+type chainEntry struct {
+	key      string
+	time     string
+	hash     string
+	prevHash string
+}
+
+// verifyDeviceChain checks the hash chain of the events a device logged at
+// a location between two times: that no sequence number is missing, that
+// every event still matches the hash it was stored with and that each one
+// points at the hash of the event before it. Sequence numbers follow the
+// order events were saved in, so neighbours of events in the range are
+// looked up by sequence number even when their time falls outside it.
+// Erased events are checked through the hashes their tombstones kept.
+// Tombstones cannot be queried by device, so the ones in the range are
+// reached through the links next to the events still present, or from the
+// chain head when none are.
+// Args: locationId, deviceId, from, to. Location events have the deviceId
+// "null".
+func (t *SimpleAsset) verifyDeviceChain(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId, deviceId, from and to")
+	}
+
+	locationID, deviceID := args[0], args[1]
+	from, err := normalizeTime(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := normalizeTime(args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	report := chainReport{LocationID: locationID, DeviceID: deviceID, From: from, To: to, Issues: []chainIssue{}}
+	entries := map[int64]*chainEntry{}
+	var hashErr error
+	queryString := deviceQuery.rangeQueryString([]string{locationID, deviceID}, from, to, nil, nil)
+	err = getEvents(stub, queryString, func(key string, e event) bool {
+		report.Events++
+		if e.Seq == 0 {
+			report.Unchained++
+			return true
+		}
+		if other, ok := entries[e.Seq]; ok {
+			report.Issues = append(report.Issues, chainIssue{Seq: e.Seq, Key: key, Kind: "duplicate", Detail: "also claimed by " + other.key})
+			return true
+		}
+		hash, err := storedHash(stub, key, e)
+		if err != nil {
+			hashErr = err
+			return false
+		}
+		entries[e.Seq] = &chainEntry{key: key, time: e.Time, hash: hash, prevHash: e.PrevHash}
+		return true
+	})
+	if err == nil {
+		err = hashErr
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	headKey, err := chainHeadKey(stub, locationID, deviceID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var head chainHead
+	if _, err := getStateJSON(stub, headKey, &head); err != nil {
+		return shim.Error(err.Error())
+	}
+	report.HeadSeq = head.Seq
+
+	var seqs []int64
+	for seq := range entries {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	if len(seqs) > 0 {
+		report.FirstSeq, report.LastSeq = seqs[0], seqs[len(seqs)-1]
+	}
+
+	// linked returns the record a link points at when it still holds the
+	// sequence number.
+	linked := func(seq int64) (*chainEntry, error) {
+		linkKey, err := chainKey(stub, locationID, deviceID, seq)
+		if err != nil {
+			return nil, err
+		}
+		var link chainLink
+		if found, err := getStateJSON(stub, linkKey, &link); err != nil || !found {
+			return nil, err
+		}
+		var e event
+		if found, err := getStateJSON(stub, link.EventKey, &e); err != nil || !found || e.Seq != seq {
+			return nil, err
+		}
+		hash, err := storedHash(stub, link.EventKey, e)
+		if err != nil {
+			return nil, err
+		}
+		return &chainEntry{key: link.EventKey, time: e.Time, hash: hash, prevHash: e.PrevHash}, nil
+	}
+	inRange := func(entry *chainEntry) bool {
+		return entry != nil && entry.time >= from && entry.time <= to
+	}
+	if len(seqs) == 0 {
+		// Nothing in the range is left but tombstones: walk back from the
+		// head over the records newer than the range.
+		for seq := report.HeadSeq; seq >= 1; seq-- {
+			entry, err := linked(seq)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if entry != nil && entry.time < from {
+				break
+			}
+			if inRange(entry) {
+				if len(seqs) == 0 {
+					report.LastSeq = seq
+				}
+				report.FirstSeq = seq
+				report.Events++
+				entries[seq] = entry
+				seqs = append(seqs, seq)
+			}
+		}
+	}
+	for len(seqs) > 0 && report.FirstSeq > 1 {
+		entry, err := linked(report.FirstSeq - 1)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !inRange(entry) {
+			break
+		}
+		report.FirstSeq--
+		report.Events++
+		entries[report.FirstSeq] = entry
+	}
+	for len(seqs) > 0 && report.LastSeq < report.HeadSeq {
+		entry, err := linked(report.LastSeq + 1)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !inRange(entry) {
+			break
+		}
+		report.LastSeq++
+		report.Events++
+		entries[report.LastSeq] = entry
+	}
+
+	// lookup returns the event holding a sequence number, reporting any
+	// problem with it. Events outside the range are read through their link.
+	checked := map[int64]bool{}
+	lookup := func(seq int64) (*chainEntry, error) {
+		linkKey, err := chainKey(stub, locationID, deviceID, seq)
+		if err != nil {
+			return nil, err
+		}
+		var link chainLink
+		found, err := getStateJSON(stub, linkKey, &link)
+		if err != nil {
+			return nil, err
+		}
+		entry, inRange := entries[seq]
+		if !inRange && found {
+			var e event
+			eventFound, err := getStateJSON(stub, link.EventKey, &e)
+			if err != nil {
+				return nil, err
+			}
+			if eventFound && e.Seq == seq {
+				hash, err := storedHash(stub, link.EventKey, e)
+				if err != nil {
+					return nil, err
+				}
+				entry = &chainEntry{key: link.EventKey, time: e.Time, hash: hash, prevHash: e.PrevHash}
+				entries[seq] = entry
+			} else if !checked[seq] && eventFound {
+				checked[seq] = true
+				report.Issues = append(report.Issues, chainIssue{Seq: seq, Key: link.EventKey, Kind: "overwritten", Detail: fmt.Sprintf("key holds sequence %d", e.Seq)})
+				return nil, nil
+			}
+		}
+		if checked[seq] {
+			return entry, nil
+		}
+		checked[seq] = true
+		switch {
+		case entry == nil && found:
+			report.Issues = append(report.Issues, chainIssue{Seq: seq, Key: link.EventKey, Kind: "missing", Detail: "event was deleted"})
+		case entry == nil:
+			report.Issues = append(report.Issues, chainIssue{Seq: seq, Kind: "missing", Detail: "no event or link for sequence"})
+		case !found:
+			report.Issues = append(report.Issues, chainIssue{Seq: seq, Key: entry.key, Kind: "missing", Detail: "no link for sequence"})
+		case link.Hash != entry.hash:
+			report.Issues = append(report.Issues, chainIssue{Seq: seq, Key: entry.key, Kind: "modified", Detail: "hash " + entry.hash + " does not match stored " + link.Hash})
+		}
+		return entry, nil
+	}
+
+	for seq := report.FirstSeq; len(seqs) > 0 && seq <= report.LastSeq; seq++ {
+		entry, err := lookup(seq)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if entry == nil {
+			continue
+		}
+		expected := ""
+		if seq > 1 {
+			prev, err := lookup(seq - 1)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if prev == nil {
+				continue
+			}
+			expected = prev.hash
+		}
+		if entry.prevHash != expected {
+			report.Issues = append(report.Issues, chainIssue{Seq: seq, Key: entry.key, Kind: "broken", Detail: "prevHash does not match the hash of sequence " + fmt.Sprint(seq-1)})
+		}
+	}
+	sort.SliceStable(report.Issues, func(i, j int) bool { return report.Issues[i].Seq < report.Issues[j].Seq })
+	report.Valid = len(report.Issues) == 0
+
+	return successJSON(report)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	seven := 7.0
+	tests := []struct {
+		name string
+		e    event
+		want string
+	}{
+		{"empty fields left out", event{DocType: "Event", DeviceID: "d1", Time: "2018-08-15t03:00:00.000z"},
+			`{"docType":"Event","deviceId":"d1","time":"2018-08-15t03:00:00.000z"}`},
+		{"canonical order", event{Seq: 2, PrevHash: "ab", Value: "on", Name: "switch", DocType: "Event"},
+			`{"docType":"Event","value":"on","name":"switch","seq":2,"prevHash":"ab"}`},
+		{"numbers and lists", event{NumericValue: &seven, EncryptedFields: []string{"description"}},
+			`{"numericValue":7,"encryptedFields":["description"]}`},
+		{"zero value kept", event{CanonicalValue: new(float64)}, `{"canonicalValue":0}`},
+		{"escaped", event{DisplayName: `"Lamp"`}, `{"displayName":"\"Lamp\""}`},
+	}
+	for _, tt := range tests {
+		if got := string(tt.e.canonicalJSON()); got != tt.want {
+			t.Errorf("%s: canonicalJSON() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalFieldsCoverEvent(t *testing.T) {
+	// Every stored field must be hashed, so a field added to event without
+	// being appended to canonicalFields fails here.
+	e := event{}
+	names := map[string]bool{}
+	for _, field := range e.canonicalFields() {
+		names[field.name] = true
+	}
+	typ := reflect.TypeOf(e)
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if !names[name] {
+			t.Errorf("field %s is not part of the canonical form", name)
+		}
+	}
+}
+
+func TestHashIgnoresUnsetFields(t *testing.T) {
+	e := event{DocType: "Event", DeviceID: "d1", Value: "on", Time: "2018-08-15t03:00:00.000z", Seq: 1}
+	with := e
+	with.SignatureStatus = ""
+	with.EncryptedFields = []string{}
+	if e.hash() != with.hash() {
+		t.Error("unset fields change the hash")
+	}
+	with.Value = "off"
+	if e.hash() == with.hash() {
+		t.Error("hash does not cover the value")
+	}
+	if strings.Contains(string(e.canonicalJSON()), "signatureStatus") {
+		t.Error("empty signatureStatus is part of the canonical form")
+	}
+}
+
+func TestChainEvent(t *testing.T) {
+	stub := shim.NewMockStub("smartthings", new(SimpleAsset))
+	stub.MockTransactionStart("tx1")
+	defer stub.MockTransactionEnd("tx1")
+
+	chain := func(locationID, deviceID, time string) event {
+		e := event{DocType: "Event", LocationID: locationID, DeviceID: deviceID, Value: "on", Time: time}
+		key, _ := stub.CreateCompositeKey("combined", []string{deviceID, time})
+		if err := chainEvent(stub, key, &e); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	first := chain("location-1", "device-1", "2018-08-15t03:00:00.000z")
+	second := chain("location-1", "device-1", "2018-08-15t02:00:00.000z")
+	other := chain("location-2", "device-1", "2018-08-15t04:00:00.000z")
+
+	if first.Seq != 1 || first.PrevHash != "" {
+		t.Errorf("first event chained as %d after %q", first.Seq, first.PrevHash)
+	}
+	// Sequence numbers follow the order events are saved in, not their
+	// times.
+	if second.Seq != 2 || second.PrevHash != first.hash() {
+		t.Errorf("second event chained as %d after %q, want 2 after %q", second.Seq, second.PrevHash, first.hash())
+	}
+	if other.Seq != 1 || other.PrevHash != "" {
+		t.Errorf("event of another location chained as %d after %q", other.Seq, other.PrevHash)
+	}
+
+	headKey, _ := chainHeadKey(stub, "location-1", "device-1")
+	var head chainHead
+	if _, err := getStateJSON(stub, headKey, &head); err != nil || head.Seq != 2 || head.Hash != second.hash() {
+		t.Errorf("head = %+v, %v", head, err)
+	}
+	linkKey, _ := chainKey(stub, "location-1", "device-1", 1)
+	var link chainLink
+	if _, err := getStateJSON(stub, linkKey, &link); err != nil || link.Hash != first.hash() || !strings.Contains(link.EventKey, "2018-08-15t03:00:00.000z") {
+		t.Errorf("link 1 = %+v, %v", link, err)
+	}
+}
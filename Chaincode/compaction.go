@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// maxCompactRange bounds the range a single compactRange call covers, so
+// that it stays within one transaction's limits.
+const maxCompactRange = 31 * 24 * time.Hour
+
+// Kinds of hourly summaries.
+const (
+	summaryNumeric = "numeric"
+	summaryState   = "state"
+)
+
+// hourlySummary condenses one hour of a device's events of one capability,
+// stored under the summary composite key of deviceId, hour and name. Hour
+// is the UTC start of the hour in the stored event time format and Date
+// the matching queryByDate date. Numeric capabilities keep Min, Max and
+// Mean, in the canonical unit when the events have one; any others are
+// treated as states and keep, per value, how often the device entered it
+// and how many seconds of the hour it spent in it, counted from the first
+// event of the hour when the state before it is not known. Last is the
+// last value of the hour. RawRemoved is set when the summarised events were
+// removed.
+type hourlySummary struct {
+	DocType     string             `json:"docType"`
+	LocationID  string             `json:"locationId"`
+	DeviceID    string             `json:"deviceId"`
+	Name        string             `json:"name"`
+	Date        string             `json:"date"`
+	Hour        string             `json:"hour"`
+	Kind        string             `json:"kind"`
+	Unit        string             `json:"unit,omitempty"`
+	Count       int                `json:"count"`
+	Min         *float64           `json:"min,omitempty"`
+	Max         *float64           `json:"max,omitempty"`
+	Mean        *float64           `json:"mean,omitempty"`
+	Transitions map[string]int     `json:"transitions,omitempty"`
+	Durations   map[string]float64 `json:"durations,omitempty"`
+	Last        string             `json:"last"`
+	LastTime    string             `json:"lastTime"`
+	RawRemoved  bool               `json:"rawRemoved"`
+}
+
+// compactReport is the response of compactRange. Skipped counts events
+// that were left raw: late events in hours whose raw events were already
+// removed, and events that hide their value, which a public summary would
+// give away.
+type compactReport struct {
+	DeviceID  string   `json:"deviceId"`
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Events    int      `json:"events"`
+	Summaries []string `json:"summaries"`
+	Removed   int      `json:"removed"`
+	Skipped   int      `json:"skipped"`
+}
+
+// hourBucket collects the events of one hour and capability.
+type hourBucket struct {
+	hour   time.Time
+	name   string
+	keys   []string
+	events []event
+}
+
+// summaryKey returns the key of the summary of a device's hour of a
+// capability.
+func summaryKey(stub shim.ChaincodeStubInterface, deviceID, hour, name string) (string, error) {
+	return stub.CreateCompositeKey("summary", []string{deviceID, hour, name})
+}
+
+// record returns the summary as a queryByDate record: the summary with the
+// hour as its time, and the mean, or for states the last one, as its
+// value. Given an output unit, the value, minimum and maximum converted to
+// it are added as convertedValue, convertedMin and convertedMax.
+func (s hourlySummary) record(unit string) (map[string]interface{}, error) {
+	summaryJSON, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(summaryJSON, &record); err != nil {
+		return nil, err
+	}
+	record["time"], record["value"], record["unit"] = s.Hour, s.Last, s.Unit
+	if s.Kind != summaryNumeric || s.Mean == nil {
+		return record, nil
+	}
+	record["value"] = strconv.FormatFloat(*s.Mean, 'g', -1, 64)
+	converted := func(value *float64) *float64 {
+		if value == nil {
+			return nil
+		}
+		reading := event{Name: s.Name, Value: strconv.FormatFloat(*value, 'g', -1, 64), Unit: s.Unit}
+		v, _ := reading.convertedTo(unit)
+		return v
+	}
+	if mean := converted(s.Mean); mean != nil {
+		record["convertedValue"], record["convertedUnit"] = *mean, unit
+		if min := converted(s.Min); min != nil {
+			record["convertedMin"] = *min
+		}
+		if max := converted(s.Max); max != nil {
+			record["convertedMax"] = *max
+		}
+	}
+	return record, nil
+}
+
+// withSummaries adds the hourly summaries of a device's day to a
+// queryByDate response, for every hour and capability whose raw events
+// were all removed, and orders the records by time. Summaries are
+// converted to unit like the raw events.
+func withSummaries(stub shim.ChaincodeStubInterface, results []byte, locationId, deviceId, date, unit string) ([]byte, error) {
+	type record struct {
+		Key    string                 `json:"Key"`
+		Record map[string]interface{} `json:"Record"`
+	}
+	var records []record
+	if err := json.Unmarshal(results, &records); err != nil {
+		return nil, err
+	}
+	raw := map[string]bool{}
+	for _, r := range records {
+		name, _ := r.Record["name"].(string)
+		at, _ := r.Record["time"].(string)
+		if t, err := parseEventTime(at); err == nil {
+			raw[t.Truncate(time.Hour).Format(eventTimeLayout)+"\x00"+name] = true
+		}
+	}
+
+	resultsIterator, err := stub.GetQueryResult(summaryQuery.queryString([]string{locationId, deviceId, date}, nil))
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var summary hourlySummary
+		if err := json.Unmarshal(queryResponse.Value, &summary); err != nil {
+			return nil, err
+		}
+		if raw[summary.Hour+"\x00"+summary.Name] {
+			continue
+		}
+		summaryRecord, err := summary.record(unit)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record{Key: strings.Replace(queryResponse.Key, "\u0000", "||", -1), Record: summaryRecord})
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		a, _ := records[i].Record["time"].(string)
+		b, _ := records[j].Record["time"].(string)
+		return a < b
+	})
+	return json.Marshal(records)
+}
+
+// summarise builds the summary of a bucket. before is the value the
+// capability had when the hour started, empty if not known.
+func summarise(b hourBucket, before string) hourlySummary {
+	first := b.events[0]
+	last := b.events[len(b.events)-1]
+	s := hourlySummary{
+		DocType:    "HourlySummary",
+		LocationID: first.LocationID,
+		DeviceID:   first.DeviceID,
+		Name:       b.name,
+		Date:       b.hour.Format("20060102"),
+		Hour:       b.hour.Format(eventTimeLayout),
+		Kind:       summaryNumeric,
+		Unit:       last.Unit,
+		Count:      len(b.events),
+		Last:       last.Value,
+		LastTime:   last.Time,
+	}
+
+	// Readings are compared in the canonical unit when all of them have
+	// one, so that an hour with a unit change still adds up.
+	canonical := true
+	for _, e := range b.events {
+		if e.CanonicalValue == nil {
+			canonical = false
+		}
+	}
+	if canonical {
+		s.Unit = last.CanonicalUnit
+		s.Last = strconv.FormatFloat(*last.CanonicalValue, 'g', -1, 64)
+	}
+	values := make([]float64, len(b.events))
+	for i, e := range b.events {
+		if canonical {
+			values[i] = *e.CanonicalValue
+			continue
+		}
+		value, err := strconv.ParseFloat(e.Value, 64)
+		if err != nil {
+			s.Kind = summaryState
+			break
+		}
+		values[i] = value
+	}
+	if s.Kind == summaryNumeric {
+		min, max, sum := values[0], values[0], 0.0
+		for _, value := range values {
+			if value < min {
+				min = value
+			}
+			if value > max {
+				max = value
+			}
+			sum += value
+		}
+		mean := sum / float64(len(values))
+		s.Min, s.Max, s.Mean = &min, &max, &mean
+		return s
+	}
+
+	s.Transitions = map[string]int{}
+	s.Durations = map[string]float64{}
+	state, since := before, b.hour
+	for _, e := range b.events {
+		at, err := parseEventTime(e.Time)
+		if err != nil {
+			continue
+		}
+		if e.Value == state {
+			continue
+		}
+		if state != "" {
+			s.Durations[state] += at.Sub(since).Seconds()
+		}
+		s.Transitions[e.Value]++
+		state, since = e.Value, at
+	}
+	s.Durations[state] += b.hour.Add(time.Hour).Sub(since).Seconds()
+	return s
+}
+
+// compactRange writes hourly summaries of a device's events between two
+// times and optionally removes the summarised events, leaving tombstones
+// like pruneExpired so that hash chains and day seals stay verifiable.
+// Only whole hours that are over are compacted: from is rounded down and
+// to rounded down to the hour. Compacting an hour again rewrites its
+// summary as long as its raw events are kept. Only the device's events at
+// the location of its latest state are read, by time. queryByDate falls
+// back to the summaries for days with no raw events left.
+// Args: deviceId, from, to and optionally "true" to remove the raw events.
+func (t *SimpleAsset) compactRange(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting deviceId, from, to and optionally removeRaw")
+	}
+
+	deviceID := args[0]
+	if deviceID == locationDeviceID {
+		return shim.Error("Location events are not compacted")
+	}
+	from, err := normalizeTime(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := normalizeTime(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	removeRaw := false
+	if len(args) == 4 && args[3] != "" {
+		if removeRaw, err = strconv.ParseBool(args[3]); err != nil {
+			return shim.Error("removeRaw must be true or false")
+		}
+	}
+
+	fromTime, _ := parseEventTime(from)
+	toTime, _ := parseEventTime(to)
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now.Before(toTime) {
+		toTime = now
+	}
+	fromTime, toTime = fromTime.Truncate(time.Hour), toTime.Truncate(time.Hour)
+	if toTime.Sub(fromTime) > maxCompactRange {
+		return shim.Error(fmt.Sprintf("Range is too long, compact at most %d days at a time", int(maxCompactRange.Hours()/24)))
+	}
+	first, end := fromTime.Format(eventTimeLayout), toTime.Format(eventTimeLayout)
+
+	// The device's latest state names the location its events are indexed
+	// under.
+	var latest eventLess
+	found, err := getStateJSON(stub, deviceID, &latest)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("Device " + deviceID + " has no events")
+	}
+
+	// Buckets are opened in time order as the device's events are read.
+	var buckets []*hourBucket
+	current := map[string]*hourBucket{}
+	report := compactReport{DeviceID: deviceID, From: first, To: end, Summaries: []string{}}
+	last := toTime.Add(-time.Millisecond).Format(eventTimeLayout)
+	queryString := deviceQuery.rangeQueryString([]string{latest.LocationID, deviceID}, first, last, nil, nil)
+	err = getEvents(stub, queryString, func(key string, e event) bool {
+		at, err := parseEventTime(e.Time)
+		if err != nil {
+			return true
+		}
+		if e.hides("value") || e.hides("unit") {
+			report.Skipped++
+			return true
+		}
+		hour := at.Truncate(time.Hour)
+		b := current[e.Name]
+		if b == nil || !b.hour.Equal(hour) {
+			b = &hourBucket{hour: hour, name: e.Name}
+			current[e.Name] = b
+			buckets = append(buckets, b)
+		}
+		b.keys = append(b.keys, key)
+		b.events = append(b.events, e)
+		return true
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// The value each capability had before the range seeds its durations:
+	// the last raw event before it, else the summary of the hour before.
+	before := map[string]string{}
+	beforeFirst := fromTime.Add(-time.Millisecond).Format(eventTimeLayout)
+	for _, b := range buckets {
+		if _, known := before[b.name]; known {
+			continue
+		}
+		queryString := readingQuery.lastQueryString([]string{latest.LocationID, deviceID, b.name}, beforeFirst)
+		err := getEvents(stub, queryString, func(key string, e event) bool {
+			if !e.hides("value") {
+				before[b.name] = e.Value
+			}
+			return false
+		})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	for _, b := range buckets {
+		hour := b.hour.Format(eventTimeLayout)
+		key, err := summaryKey(stub, deviceID, hour, b.name)
+		if err != nil {
+			return shim.Error("Failed to set composite key")
+		}
+		var existing hourlySummary
+		found, err := getStateJSON(stub, key, &existing)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if found && existing.RawRemoved {
+			report.Skipped += len(b.events)
+			before[b.name] = existing.Last
+			continue
+		}
+		state, known := before[b.name]
+		if !known {
+			// The events before the range may already have been compacted.
+			previous, err := summaryKey(stub, deviceID, b.hour.Add(-time.Hour).Format(eventTimeLayout), b.name)
+			if err != nil {
+				return shim.Error("Failed to set composite key")
+			}
+			var summary hourlySummary
+			if _, err := getStateJSON(stub, previous, &summary); err != nil {
+				return shim.Error(err.Error())
+			}
+			state = summary.Last
+		}
+		summary := summarise(*b, state)
+		summary.RawRemoved = removeRaw
+		if err := putStateJSON(stub, key, summary); err != nil {
+			return shim.Error("Failed to set summary")
+		}
+		before[b.name] = summary.Last
+		report.Events += len(b.events)
+		report.Summaries = append(report.Summaries, key)
+
+		if !removeRaw {
+			continue
+		}
+		for i, e := range b.events {
+			if _, err := tombstoneEvent(stub, b.keys[i], e, "compacted", ""); err != nil {
+				return shim.Error("Failed to remove event: " + err.Error())
+			}
+			report.Removed++
+		}
+	}
+
+	return successJSON(report)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSummarise(t *testing.T) {
+	hour := time.Date(2018, 8, 1, 1, 0, 0, 0, time.UTC)
+	at := func(minute int) string { return hour.Add(time.Duration(minute) * time.Minute).Format(eventTimeLayout) }
+	f, c := 71.6, 22.0
+	tests := []struct {
+		name        string
+		events      []event
+		before      string
+		kind        string
+		min, max    float64
+		unit        string
+		last        string
+		transitions map[string]int
+		durations   map[string]float64
+	}{
+		{"numeric", []event{{Value: "20", Unit: "c", Time: at(0)}, {Value: "24", Unit: "c", Time: at(30)}}, "",
+			summaryNumeric, 20, 24, "c", "24", nil, nil},
+		{"canonical", []event{{Value: "71.6", Unit: "f", CanonicalValue: &c, CanonicalUnit: "C", Time: at(0)}, {Value: "22", Unit: "c", CanonicalValue: &c, CanonicalUnit: "C", Time: at(30)}}, "",
+			summaryNumeric, 22, 22, "C", "22", nil, nil},
+		{"mixed units without canonical", []event{{Value: "71.6", Unit: "f", CanonicalValue: &f, Time: at(0)}, {Value: "22", Unit: "c", Time: at(30)}}, "",
+			summaryNumeric, 22, 71.6, "c", "22", nil, nil},
+		{"state known before", []event{{Value: "open", Time: at(15)}, {Value: "closed", Time: at(45)}}, "closed",
+			summaryState, 0, 0, "", "closed", map[string]int{"open": 1, "closed": 1}, map[string]float64{"closed": 1800, "open": 1800}},
+		{"state unknown before", []event{{Value: "open", Time: at(15)}, {Value: "open", Time: at(30)}}, "",
+			summaryState, 0, 0, "", "open", map[string]int{"open": 1}, map[string]float64{"open": 2700}},
+	}
+	for _, tt := range tests {
+		s := summarise(hourBucket{hour: hour, name: "x", events: tt.events}, tt.before)
+		if s.Kind != tt.kind || s.Unit != tt.unit || s.Last != tt.last || s.Count != len(tt.events) || s.Hour != at(0) || s.Date != "20180801" {
+			t.Errorf("%s: summarise() = %+v", tt.name, s)
+			continue
+		}
+		if tt.kind == summaryNumeric && (*s.Min != tt.min || *s.Max != tt.max) {
+			t.Errorf("%s: min, max = %v, %v, want %v, %v", tt.name, *s.Min, *s.Max, tt.min, tt.max)
+		}
+		if tt.kind == summaryState && (!reflect.DeepEqual(s.Transitions, tt.transitions) || !reflect.DeepEqual(s.Durations, tt.durations)) {
+			t.Errorf("%s: transitions %v durations %v, want %v %v", tt.name, s.Transitions, s.Durations, tt.transitions, tt.durations)
+		}
+	}
+}
+
+func TestHourlySummaryRecord(t *testing.T) {
+	min, max, mean := 20.0, 30.0, 25.0
+	numeric := hourlySummary{Name: "temperature", Hour: "2018-08-01t01:00:00.000z", Kind: summaryNumeric, Unit: "C", Min: &min, Max: &max, Mean: &mean, Last: "30"}
+	state := hourlySummary{Name: "contact", Hour: "2018-08-01t02:00:00.000z", Kind: summaryState, Last: "open"}
+	tests := []struct {
+		name    string
+		summary hourlySummary
+		unit    string
+		want    map[string]interface{}
+	}{
+		{"numeric", numeric, "", map[string]interface{}{"time": numeric.Hour, "value": "25", "unit": "C"}},
+		{"converted", numeric, "F", map[string]interface{}{"time": numeric.Hour, "value": "25", "unit": "C",
+			"convertedValue": 77.0, "convertedUnit": "F", "convertedMin": 68.0, "convertedMax": 86.0}},
+		{"state", state, "F", map[string]interface{}{"time": state.Hour, "value": "open", "unit": ""}},
+	}
+	for _, tt := range tests {
+		record, err := tt.summary.record(tt.unit)
+		if err != nil {
+			t.Errorf("%s: record() error %v", tt.name, err)
+			continue
+		}
+		for field, want := range tt.want {
+			if got, ok := record[field].(float64); ok {
+				if math.Abs(got-want.(float64)) > 1e-9 {
+					t.Errorf("%s: %s = %v, want %v", tt.name, field, got, want)
+				}
+			} else if record[field] != want {
+				t.Errorf("%s: %s = %v, want %v", tt.name, field, record[field], want)
+			}
+		}
+		if _, converted := record["convertedValue"]; converted != (tt.want["convertedValue"] != nil) {
+			t.Errorf("%s: record() = %v", tt.name, record)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// locationDeviceID is the deviceId of location events such as mode
+// changes. Every location shares it, so nothing is recorded under it that
+// is keyed by deviceId alone except its latest state, which belongs to the
+// location that logged last.
+const locationDeviceID = "null"
+
+// locationDevice is a device that has logged events for a location, as
+// recorded by its EventLess document.
+type locationDevice struct {
+	DeviceID string
+	Latest   eventLess
+}
+
+// deviceRecord is what the chaincode knows about a device beyond its latest
+// state. Capabilities maps each capability the device has reported to the
+// time it last did. It is assembled from the device's capability records
+// by getDeviceRecord.
+type deviceRecord struct {
+	DocType      string            `json:"docType"`
+	DeviceID     string            `json:"deviceId"`
+	LocationID   string            `json:"locationId"`
+	Capabilities map[string]string `json:"capabilities"`
+}
+
+// deviceCapability records when a device last reported a capability,
+// stored under the device composite key of deviceId and capability. Each
+// event overwrites it without reading it first, so events of one device
+// in the same block do not conflict; an event arriving late sets the time
+// back until the capability reports again.
+type deviceCapability struct {
+	DocType    string `json:"docType"`
+	DeviceID   string `json:"deviceId"`
+	LocationID string `json:"locationId"`
+	Name       string `json:"name"`
+	Time       string `json:"time"`
+}
+
+// deviceRename is a change of a device's display name or label, found
+// between two consecutive events of the device.
+type deviceRename struct {
+	DeviceID   string `json:"deviceId"`
+	LocationID string `json:"locationId"`
+	Field      string `json:"field"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Time       string `json:"time"`
+	EventKey   string `json:"eventKey"`
+}
+
+// lastReported returns the time of the latest event on record.
+func (r deviceRecord) lastReported() string {
+	last := ""
+	for _, at := range r.Capabilities {
+		if at > last {
+			last = at
+		}
+	}
+	return last
+}
+
+// updateDeviceRecord is called by saveNewEvent to record the capability a
+// device event reported.
+func updateDeviceRecord(stub shim.ChaincodeStubInterface, e event) error {
+	if e.DeviceID == locationDeviceID {
+		return nil
+	}
+	key, err := stub.CreateCompositeKey("device", []string{e.DeviceID, e.Name})
+	if err != nil {
+		return err
+	}
+	return putStateJSON(stub, key, deviceCapability{DocType: "DeviceCapability", DeviceID: e.DeviceID, LocationID: e.LocationID, Name: e.Name, Time: e.Time})
+}
+
+// deviceAliasesReport is the response of deviceAliases. Original holds the
+// names the device had before its first recorded rename and Aliases every
+// display name and label it has been known by, oldest first.
+type deviceAliasesReport struct {
+	DeviceID string         `json:"deviceId"`
+	Current  deviceNames    `json:"current"`
+	Original deviceNames    `json:"original"`
+	Aliases  []string       `json:"aliases"`
+	Renames  []deviceRename `json:"renames"`
+}
+
+// deviceNames is a display name with its label.
+type deviceNames struct {
+	DisplayName string `json:"displayName"`
+	Label       string `json:"label"`
+}
+
+// deviceAliases returns the current and original names of a device with
+// its rename history, so old events can be shown under either name. The
+// renames are found in the device's stored events, oldest first, with
+// their names as far as the caller may read them (see detailsReader).
+// Args: deviceId.
+func (t *SimpleAsset) deviceAliases(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting deviceId")
+	}
+
+	record, found, err := getDeviceRecord(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("Unknown device " + args[0])
+	}
+
+	report := deviceAliasesReport{DeviceID: args[0], Renames: []deviceRename{}}
+	details := newDetailsReader(stub)
+	var mergeErr error
+	seen := false
+	queryString := deviceQuery.rangeQueryString([]string{record.LocationID, args[0]}, "", "", nil, nil)
+	err = getEvents(stub, queryString, func(key string, e event) bool {
+		if mergeErr = details.merge(key, &e); mergeErr != nil {
+			return false
+		}
+		names := deviceNames{DisplayName: e.DisplayName, Label: e.Device}
+		if seen {
+			report.addRenames(report.Current, names, e.Time, key)
+		}
+		report.Current, seen = names, true
+		return true
+	})
+	if err == nil {
+		err = mergeErr
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for i := range report.Renames {
+		report.Renames[i].DeviceID = args[0]
+		report.Renames[i].LocationID = record.LocationID
+	}
+	report.resolve()
+
+	return successJSON(report)
+}
+
+// addRenames records the changes between the names of two consecutive
+// events. Events without a label, such as those saved by early loggers,
+// do not count as a label change.
+func (report *deviceAliasesReport) addRenames(from, to deviceNames, at, eventKey string) {
+	renames := []deviceRename{
+		{Field: "displayName", From: from.DisplayName, To: to.DisplayName},
+		{Field: "label", From: from.Label, To: to.Label},
+	}
+	for _, rename := range renames {
+		if rename.From == "" || rename.To == "" || rename.From == rename.To {
+			continue
+		}
+		rename.Time = at
+		rename.EventKey = eventKey
+		report.Renames = append(report.Renames, rename)
+	}
+}
+
+// resolve works out the original names and the aliases of the report's
+// device from its renames, which have to be in time order.
+func (report *deviceAliasesReport) resolve() {
+	report.Original = report.Current
+	seenField := map[string]bool{}
+	for _, rename := range report.Renames {
+		if seenField[rename.Field] {
+			continue
+		}
+		seenField[rename.Field] = true
+		if rename.Field == "label" {
+			report.Original.Label = rename.From
+		} else {
+			report.Original.DisplayName = rename.From
+		}
+	}
+
+	report.Aliases = nil
+	seen := map[string]bool{}
+	addAlias := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			report.Aliases = append(report.Aliases, name)
+		}
+	}
+	addAlias(report.Original.DisplayName)
+	addAlias(report.Original.Label)
+	for _, rename := range report.Renames {
+		addAlias(rename.To)
+	}
+	addAlias(report.Current.DisplayName)
+	addAlias(report.Current.Label)
+}
+
+// getDeviceRecord assembles the record of a device from its capability
+// records. Devices last updated before capabilities had records of their
+// own may still have a single Device document under the device key,
+// which is merged in. Devices that have not logged anything since records
+// were introduced have none.
+func getDeviceRecord(stub shim.ChaincodeStubInterface, deviceID string) (deviceRecord, bool, error) {
+	record := deviceRecord{DocType: "Device", DeviceID: deviceID, Capabilities: map[string]string{}}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("device", []string{deviceID})
+	if err != nil {
+		return record, false, err
+	}
+	defer resultsIterator.Close()
+
+	found := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return record, false, err
+		}
+		var doc struct {
+			deviceCapability
+			Capabilities map[string]string `json:"capabilities"`
+		}
+		if err := json.Unmarshal(queryResponse.Value, &doc); err != nil {
+			return record, false, err
+		}
+		found = true
+		if record.LocationID == "" || doc.DocType == "DeviceCapability" {
+			record.LocationID = doc.LocationID
+		}
+		if doc.DocType == "DeviceCapability" {
+			doc.Capabilities = map[string]string{doc.Name: doc.Time}
+		}
+		for name, at := range doc.Capabilities {
+			if at > record.Capabilities[name] {
+				record.Capabilities[name] = at
+			}
+		}
+	}
+	return record, found, nil
+}
+
+// getLocationDevices returns the devices of a location ordered by deviceId.
+func getLocationDevices(stub shim.ChaincodeStubInterface, locationId string) ([]locationDevice, error) {
+	resultsIterator, err := stub.GetQueryResult(locationQuery.queryString([]string{locationId}, nil))
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	details := newDetailsReader(stub)
+	var devices []locationDevice
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		device := locationDevice{DeviceID: queryResponse.Key}
+		if err := json.Unmarshal(queryResponse.Value, &device.Latest); err != nil {
+			return nil, err
+		}
+		if err := details.revealLatest(&device.Latest); err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+	return devices, nil
+}
+
+// revealLatest fills in the name and value a latest state leaves out, if
+// the caller may read its event.
+func (r *detailsReader) revealLatest(latest *eventLess) error {
+	if !latest.Hidden {
+		return nil
+	}
+	e, ok, err := r.event(latest.EventKey)
+	if err != nil || !ok {
+		return err
+	}
+	latest.DisplayName, latest.Value, latest.Hidden = e.DisplayName, e.Value, false
+	return nil
+}
+
+// getEvents calls visit with the Event documents returned by a rich query,
+// in the order CouchDB returns them. Iteration stops early when visit
+// returns false.
+func getEvents(stub shim.ChaincodeStubInterface, queryString string, visit func(key string, e event) bool) error {
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		var e event
+		if err := json.Unmarshal(queryResponse.Value, &e); err != nil {
+			return err
+		}
+		if !visit(queryResponse.Key, e) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// getMergedEvents is getEvents for events merged as far as the caller may
+// read them. Events the query's filters let through for hiding the
+// filtered field are skipped unless they match once merged.
+func getMergedEvents(stub shim.ChaincodeStubInterface, queryString string, filters []queryFilter, visit func(key string, e event) bool) error {
+	details := newDetailsReader(stub)
+	var mergeErr error
+	err := getEvents(stub, queryString, func(key string, e event) bool {
+		if mergeErr = details.merge(key, &e); mergeErr != nil {
+			return false
+		}
+		return !matchesAll(filters, &e) || visit(key, e)
+	})
+	if err == nil {
+		err = mergeErr
+	}
+	return err
+}
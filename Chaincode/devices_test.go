@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeviceAliasesResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		report   deviceAliasesReport
+		original deviceNames
+		aliases  []string
+	}{
+		{
+			"never renamed",
+			deviceAliasesReport{Current: deviceNames{DisplayName: "Lamp", Label: "lamp"}},
+			deviceNames{DisplayName: "Lamp", Label: "lamp"},
+			[]string{"Lamp", "lamp"},
+		},
+		{
+			"renamed twice",
+			deviceAliasesReport{
+				Current: deviceNames{DisplayName: "Reading Lamp", Label: "lamp2"},
+				Renames: []deviceRename{
+					{Field: "displayName", From: "Lamp", To: "Desk Lamp"},
+					{Field: "label", From: "lamp", To: "lamp2"},
+					{Field: "displayName", From: "Desk Lamp", To: "Reading Lamp"},
+				},
+			},
+			deviceNames{DisplayName: "Lamp", Label: "lamp"},
+			[]string{"Lamp", "lamp", "Desk Lamp", "lamp2", "Reading Lamp"},
+		},
+		{
+			"renamed back",
+			deviceAliasesReport{
+				Current: deviceNames{DisplayName: "Lamp"},
+				Renames: []deviceRename{
+					{Field: "displayName", From: "Lamp", To: "Desk Lamp"},
+					{Field: "displayName", From: "Desk Lamp", To: "Lamp"},
+				},
+			},
+			deviceNames{DisplayName: "Lamp"},
+			[]string{"Lamp", "Desk Lamp"},
+		},
+	}
+	for _, tt := range tests {
+		report := tt.report
+		report.resolve()
+		if report.Original != tt.original || !reflect.DeepEqual(report.Aliases, tt.aliases) {
+			t.Errorf("%s: original %+v, aliases %q", tt.name, report.Original, report.Aliases)
+		}
+	}
+}
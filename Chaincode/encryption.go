@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// Transient map entries carrying encryption keys. Each key is passed as
+// "key:<keyId>" with 16, 24 or 32 raw bytes; saveNewEvent encrypts with the
+// key named by the encryptionKeyId entry, queries decrypt with whichever
+// keys they are given.
+const (
+	transientKeyPrefix = "key:"
+	transientKeyID     = "encryptionKeyId"
+)
+
+// encryptableFields are the event fields a location may encrypt. Fields
+// that queries select or sort on by index stay in plaintext.
+var encryptableFields = map[string]bool{
+	"displayName": true, "device": true, "location": true, "description": true,
+	"descriptionText": true, "value": true, "unit": true,
+}
+
+// derivedFields are the encryptable fields that derived records would copy
+// in plaintext. Events encrypting one of them hide it from those records
+// too (see hidesDerived).
+var derivedFields = []string{"displayName", "device", "value", "unit"}
+
+// encryptionPolicy lists the fields a location encrypts with AES-GCM,
+// stored under the encryption composite key of locationId. Locations with a
+// policy keep their events in world state only, with those fields
+// encrypted, instead of moving details to a private data collection.
+type encryptionPolicy struct {
+	DocType    string   `json:"docType"`
+	LocationID string   `json:"locationId"`
+	Fields     []string `json:"fields"`
+}
+
+// setEncryptedFields sets the fields a location encrypts. An empty list
+// turns encryption off for new events.
+// Args: locationId, fields as a JSON array, e.g. ["displayName","value"].
+func (t *SimpleAsset) setEncryptedFields(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and fields")
+	}
+
+	policy := encryptionPolicy{DocType: "EncryptionPolicy", LocationID: args[0]}
+	if err := json.Unmarshal([]byte(args[1]), &policy.Fields); err != nil {
+		return shim.Error("invalid fields: " + err.Error())
+	}
+	seen := map[string]bool{}
+	for _, field := range policy.Fields {
+		if !encryptableFields[field] {
+			return shim.Error(fmt.Sprintf("field %q cannot be encrypted", field))
+		}
+		if seen[field] {
+			return shim.Error(fmt.Sprintf("field %q is listed twice", field))
+		}
+		seen[field] = true
+	}
+	sort.Strings(policy.Fields)
+
+	key, err := stub.CreateCompositeKey("encryption", []string{policy.LocationID})
+	if err != nil {
+		return shim.Error("Failed to set composite key")
+	}
+	if len(policy.Fields) == 0 {
+		if err := stub.DelState(key); err != nil {
+			return shim.Error("Failed to delete encryption policy")
+		}
+		policy.Fields = []string{}
+		return successJSON(policy)
+	}
+	if err := putStateJSON(stub, key, policy); err != nil {
+		return shim.Error("Failed to set encryption policy")
+	}
+	return successJSON(policy)
+}
+
+// getEncryptedFields returns the fields a location encrypts.
+// Args: locationId.
+func (t *SimpleAsset) getEncryptedFields(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId")
+	}
+
+	policy, found, err := loadEncryptionPolicy(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		policy = encryptionPolicy{DocType: "EncryptionPolicy", LocationID: args[0], Fields: []string{}}
+	}
+	return successJSON(policy)
+}
+
+// loadEncryptionPolicy loads the encryption policy of a location.
+func loadEncryptionPolicy(stub shim.ChaincodeStubInterface, locationId string) (encryptionPolicy, bool, error) {
+	var policy encryptionPolicy
+	key, err := stub.CreateCompositeKey("encryption", []string{locationId})
+	if err != nil {
+		return policy, false, err
+	}
+	found, err := getStateJSON(stub, key, &policy)
+	return policy, found, err
+}
+
+// transientKeys returns the encryption keys passed in the transient map by
+// keyId.
+func transientKeys(stub shim.ChaincodeStubInterface) (map[string][]byte, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string][]byte{}
+	for name, key := range transient {
+		if !strings.HasPrefix(name, transientKeyPrefix) {
+			continue
+		}
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("key %s must be 16, 24 or 32 bytes", strings.TrimPrefix(name, transientKeyPrefix))
+		}
+		keys[strings.TrimPrefix(name, transientKeyPrefix)] = key
+	}
+	return keys, nil
+}
+
+// field returns the event field with the given JSON name, if queries may
+// merge it back in.
+func (e *event) field(name string) *string {
+	switch name {
+	case "installedSmartAppId":
+		return &e.InstalledSmartAppID
+	case "isDigital":
+		return &e.IsDigital
+	case "isPhysical":
+		return &e.IsPhysical
+	case "source":
+		return &e.Source
+	case "displayName":
+		return &e.DisplayName
+	case "device":
+		return &e.Device
+	case "location":
+		return &e.Location
+	case "description":
+		return &e.Description
+	case "descriptionText":
+		return &e.DescriptionText
+	case "value":
+		return &e.Value
+	case "unit":
+		return &e.Unit
+	}
+	return nil
+}
+
+// newFieldCipher returns the AES-GCM cipher for a key.
+func newFieldCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// fieldData binds a ciphertext to the record and field it was made for,
+// so it cannot be moved to another one.
+func fieldData(recordKey, field string) []byte {
+	return []byte(recordKey + "\x00" + field)
+}
+
+// encryptFields encrypts the named fields of a record in place and returns
+// the ones that were encrypted; empty fields are left alone. Every
+// endorsing peer has to write the same ciphertext, so the nonce is derived
+// from the key, the transaction ID, the record and the field instead of
+// being random. The transaction ID makes it unique.
+func encryptFields(stub shim.ChaincodeStubInterface, field func(string) *string, names []string, key []byte, recordKey string) ([]string, error) {
+	aead, err := newFieldCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := []string{}
+	for _, name := range names {
+		value := field(name)
+		if value == nil || *value == "" {
+			continue
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(stub.GetTxID() + "\x00" + recordKey + "\x00" + name))
+		nonce := mac.Sum(nil)[:aead.NonceSize()]
+		sealed := aead.Seal(nonce, nonce, []byte(*value), fieldData(recordKey, name))
+		*value = base64.StdEncoding.EncodeToString(sealed)
+		encrypted = append(encrypted, name)
+	}
+	return encrypted, nil
+}
+
+// decryptField decrypts one field value.
+func decryptField(key []byte, recordKey, name, value string) (string, error) {
+	aead, err := newFieldCipher(key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed ciphertext")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], fieldData(recordKey, name))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// encryptEvent encrypts the policy's fields of an event with the key the
+// transient map names. An encrypted value or unit takes the numeric forms
+// of the value with it.
+func encryptEvent(stub shim.ChaincodeStubInterface, policy encryptionPolicy, eventKey string, e *event) error {
+	keys, err := transientKeys(stub)
+	if err != nil {
+		return err
+	}
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return err
+	}
+	keyID := string(transient[transientKeyID])
+	key, ok := keys[keyID]
+	if !ok {
+		return errors.New("location encrypts events, expecting " + transientKeyID + " and the matching " + transientKeyPrefix + "<keyId> in the transient map")
+	}
+
+	if e.EncryptedFields, err = encryptFields(stub, e.field, policy.Fields, key, eventKey); err != nil {
+		return err
+	}
+	if len(e.EncryptedFields) > 0 {
+		e.EncryptionKeyID = keyID
+	}
+	if e.hides("value") || e.hides("unit") {
+		e.NumericValue, e.NumericUnit, e.CanonicalValue, e.CanonicalUnit = nil, "", nil, ""
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+func TestHidesDerived(t *testing.T) {
+	tests := []struct {
+		name string
+		e    event
+		want bool
+	}{
+		{"plain", event{Value: "on"}, false},
+		{"free text encrypted", event{EncryptedFields: []string{"location", "description", "descriptionText"}}, false},
+		{"name encrypted", event{EncryptedFields: []string{"description", "displayName"}}, true},
+		{"value encrypted", event{EncryptedFields: []string{"value"}}, true},
+		{"unit encrypted", event{EncryptedFields: []string{"unit"}}, true},
+		{"private", event{DetailsCollection: "detailsOrg1MSP"}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.e.hidesDerived(); got != tt.want {
+			t.Errorf("%s: hidesDerived() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	for _, field := range derivedFields {
+		if !encryptableFields[field] {
+			t.Errorf("derived field %s cannot be encrypted", field)
+		}
+	}
+}
+
+func TestDecryptField(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	aead, err := newFieldCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	sealed := base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte("front door unlocked"), fieldData("k1", "description")))
+
+	tests := []struct {
+		name      string
+		key       []byte
+		recordKey string
+		field     string
+		value     string
+		ok        bool
+	}{
+		{"matching", key, "k1", "description", sealed, true},
+		{"other key", []byte("fedcba9876543210"), "k1", "description", sealed, false},
+		{"other record", key, "k2", "description", sealed, false},
+		{"other field", key, "k1", "descriptionText", sealed, false},
+		{"not base64", key, "k1", "description", "front door", false},
+		{"too short", key, "k1", "description", "AAAA", false},
+	}
+	for _, tt := range tests {
+		plain, err := decryptField(tt.key, tt.recordKey, tt.field, tt.value)
+		if (err == nil) != tt.ok || (tt.ok && plain != "front door unlocked") {
+			t.Errorf("%s: decryptField() = %q, %v", tt.name, plain, err)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// standardTariff names the consumption outside every configured window.
+const standardTariff = "standard"
+
+// tariffWindow is a daily window, in the location's timezone, with its own
+// rate.
+type tariffWindow struct {
+	Name string `json:"name"`
+	dailyWindow
+	Rate float64 `json:"rate"`
+}
+
+// tariffConfig holds the tariff windows of a location.
+type tariffConfig struct {
+	DocType      string         `json:"docType"`
+	LocationID   string         `json:"locationId"`
+	StandardRate float64        `json:"standardRate"`
+	Windows      []tariffWindow `json:"windows"`
+}
+
+// energyPeriod is the consumption of one day or month, split by tariff.
+type energyPeriod struct {
+	Period  string             `json:"period"`
+	KWh     float64            `json:"kWh"`
+	Tariffs map[string]float64 `json:"tariffs"`
+	Cost    float64            `json:"cost"`
+}
+
+// deviceEnergy is the consumption of one meter. Method is "energy" when it
+// was computed from cumulative energy readings and "power" when power
+// readings were integrated over time.
+type deviceEnergy struct {
+	DeviceID    string          `json:"deviceId"`
+	DisplayName string          `json:"displayName"`
+	Method      string          `json:"method"`
+	Resets      int             `json:"resets"`
+	KWh         float64         `json:"kWh"`
+	Periods     []*energyPeriod `json:"periods"`
+
+	byPeriod map[string]*energyPeriod
+}
+
+// energyReport is the response of energyUsage.
+type energyReport struct {
+	LocationID string          `json:"locationId"`
+	From       string          `json:"from"`
+	To         string          `json:"to"`
+	Period     string          `json:"period"`
+	Timezone   string          `json:"timezone"`
+	Devices    []*deviceEnergy `json:"devices"`
+	Totals     []*energyPeriod `json:"totals"`
+	KWh        float64         `json:"kWh"`
+	Cost       float64         `json:"cost"`
+}
+
+// energyCapabilities are the capabilities meters report, in the order
+// they are read.
+var energyCapabilities = []string{"power", "energy"}
+
+// energyReading is a power reading in kW or an energy reading in kWh.
+type energyReading struct {
+	at    time.Time
+	value float64
+}
+
+// energyInterval is the kWh a meter consumed between two times. Reset is
+// set when the meter was reset during the interval.
+type energyInterval struct {
+	from, to time.Time
+	kWh      float64
+	reset    bool
+}
+
+// energyIntervals differences cumulative energy readings, in time order,
+// into the consumption between each reading and the next. A drop in the
+// reading is taken as a meter reset, after which the meter counted up from
+// zero.
+func energyIntervals(readings []energyReading) []energyInterval {
+	var intervals []energyInterval
+	for i := 1; i < len(readings); i++ {
+		interval := energyInterval{from: readings[i-1].at, to: readings[i].at, kWh: readings[i].value - readings[i-1].value}
+		if interval.kWh < 0 {
+			interval.kWh, interval.reset = readings[i].value, true
+		}
+		intervals = append(intervals, interval)
+	}
+	return intervals
+}
+
+// powerIntervals integrates power readings, in time order, over time. Each
+// reading holds until the next one, and the last until end.
+func powerIntervals(readings []energyReading, end time.Time) []energyInterval {
+	var intervals []energyInterval
+	for i, r := range readings {
+		until := end
+		if i+1 < len(readings) {
+			until = readings[i+1].at
+		}
+		if !until.After(r.at) {
+			continue
+		}
+		intervals = append(intervals, energyInterval{from: r.at, to: until, kWh: r.value * until.Sub(r.at).Hours()})
+	}
+	return intervals
+}
+
+// clip returns the part of the interval between start and end, with its
+// kWh prorated over the time it covers. Readings taken at the same moment
+// give an interval with no duration, which belongs to a range when it
+// lies at or after start and before end, so that adjoining ranges do not
+// both count it. clip reports false when nothing of the interval is left.
+func (i energyInterval) clip(start, end time.Time) (energyInterval, bool) {
+	if i.from.Equal(i.to) {
+		return i, !i.from.Before(start) && i.from.Before(end)
+	}
+	clipped := i
+	if clipped.from.Before(start) {
+		clipped.from = start
+	}
+	if clipped.to.After(end) {
+		clipped.to = end
+	}
+	if !clipped.to.After(clipped.from) {
+		return energyInterval{}, false
+	}
+	clipped.kWh = i.kWh * float64(clipped.to.Sub(clipped.from)) / float64(i.to.Sub(i.from))
+	return clipped, true
+}
+
+// putTariffs stores the tariff windows of a location. They decide how
+// usage is billed, so only administrators may call it (see requireAdmin).
+// Args: locationId, tariffs as JSON, e.g.
+// {"standardRate":0.15,"windows":[{"name":"peak","start":"16:00","end":"21:00","days":["mon","tue","wed","thu","fri"],"rate":0.35}]}
+func (t *SimpleAsset) putTariffs(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and tariffs")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var config tariffConfig
+	if err := json.Unmarshal([]byte(args[1]), &config); err != nil {
+		return shim.Error("invalid tariffs: " + err.Error())
+	}
+	config.DocType = "Tariffs"
+	config.LocationID = args[0]
+	if err := config.validate(); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey("tariffs", []string{config.LocationID})
+	if err != nil {
+		return shim.Error("Failed to set composite key")
+	}
+	if err := putStateJSON(stub, key, config); err != nil {
+		return shim.Error("Failed to set tariffs")
+	}
+	return successJSON(config)
+}
+
+// getTariffs returns the tariff windows of a location.
+// Args: locationId.
+func (t *SimpleAsset) getTariffs(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId")
+	}
+
+	config, err := getTariffConfig(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return successJSON(config)
+}
+
+// getTariffConfig loads the tariffs of a location. Locations without
+// tariffs bill everything at a zero standard rate.
+func getTariffConfig(stub shim.ChaincodeStubInterface, locationId string) (tariffConfig, error) {
+	config := tariffConfig{DocType: "Tariffs", LocationID: locationId, Windows: []tariffWindow{}}
+	key, err := stub.CreateCompositeKey("tariffs", []string{locationId})
+	if err != nil {
+		return config, err
+	}
+	if _, err := getStateJSON(stub, key, &config); err != nil {
+		return config, err
+	}
+	return config, config.validate()
+}
+
+// validate checks the windows and resolves their start and end minutes.
+func (c *tariffConfig) validate() error {
+	names := map[string]bool{standardTariff: true}
+	for i := range c.Windows {
+		w := &c.Windows[i]
+		if w.Name == "" || names[w.Name] {
+			return fmt.Errorf("tariff window names must be unique and not %q", standardTariff)
+		}
+		names[w.Name] = true
+		if err := w.resolve(); err != nil {
+			return fmt.Errorf("tariff window %s: %s", w.Name, err)
+		}
+	}
+	return nil
+}
+
+// tariffAt returns the name and rate of the tariff in force at local time t.
+func (c tariffConfig) tariffAt(t time.Time) (string, float64) {
+	for _, w := range c.Windows {
+		if w.contains(t) {
+			return w.Name, w.Rate
+		}
+	}
+	return standardTariff, c.StandardRate
+}
+
+// nextBoundary returns the first time after t, in t's location, at which
+// the day or the tariff in force may change.
+func (c tariffConfig) nextBoundary(t time.Time) time.Time {
+	windows := make([]dailyWindow, len(c.Windows))
+	for i, w := range c.Windows {
+		windows[i] = w.dailyWindow
+	}
+	return nextEdge(t, windows)
+}
+
+// periodKey names the day or month local time t falls into.
+func periodKey(t time.Time, period string) string {
+	if period == "month" {
+		return t.Format("2006-01")
+	}
+	return t.Format("2006-01-02")
+}
+
+// add books kWh consumed at local time t.
+func (d *deviceEnergy) add(t time.Time, period string, config tariffConfig, kWh float64) {
+	key := periodKey(t, period)
+	p, ok := d.byPeriod[key]
+	if !ok {
+		p = &energyPeriod{Period: key, Tariffs: map[string]float64{}}
+		d.byPeriod[key] = p
+	}
+	name, rate := config.tariffAt(t)
+	p.KWh += kWh
+	p.Tariffs[name] += kWh
+	p.Cost += kWh * rate
+	d.KWh += kWh
+}
+
+// spread books kWh consumed evenly between from and to, splitting it at
+// day and tariff boundaries.
+func (d *deviceEnergy) spread(from, to time.Time, loc *time.Location, period string, config tariffConfig, kWh float64) {
+	from, to = from.In(loc), to.In(loc)
+	total := to.Sub(from)
+	if total <= 0 {
+		d.add(to, period, config, kWh)
+		return
+	}
+	for cur := from; cur.Before(to); {
+		next := config.nextBoundary(cur)
+		if next.After(to) {
+			next = to
+		}
+		d.add(cur, period, config, kWh*float64(next.Sub(cur))/float64(total))
+		cur = next
+	}
+}
+
+// energyUsage reports the kWh consumed per meter and per day or month,
+// split by tariff window, together with location totals. Meters reporting
+// cumulative energy are differenced, treating a drop in the reading as a
+// meter reset; meters reporting only power have their readings integrated
+// over time, each reading holding until the next one. The readings either
+// side of the range are read as well and the intervals spanning its ends
+// prorated, so that the days of a month add up to the month.
+// Args: locationId, from, to, period ("day" or "month").
+func (t *SimpleAsset) energyUsage(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId, from, to and period")
+	}
+
+	locationId := args[0]
+	from, err := normalizeTime(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := normalizeTime(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	period := strings.ToLower(args[3])
+	if period != "day" && period != "month" {
+		return shim.Error("period must be day or month")
+	}
+
+	config, err := getTariffConfig(stub, locationId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	loc, err := getLocationTimezone(stub, locationId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Consumption is counted up to the end of the range but never past the
+	// time of this transaction.
+	start, _ := parseEventTime(from)
+	end, _ := parseEventTime(to)
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now.Before(end) {
+		end = now
+	}
+
+	details := newDetailsReader(stub)
+	devices := map[string]*deviceEnergy{}
+	readings := map[string]map[string][]energyReading{"power": {}, "energy": {}}
+	for _, name := range energyCapabilities {
+		queryString := capabilityQuery.rangeQueryString([]string{locationId, name}, from, to, nil, nil)
+		err := readEnergy(stub, details, queryString, name, func(e event, r energyReading) {
+			if _, ok := devices[e.DeviceID]; !ok {
+				devices[e.DeviceID] = &deviceEnergy{DeviceID: e.DeviceID, byPeriod: map[string]*energyPeriod{}}
+			}
+			devices[e.DeviceID].DisplayName = e.DisplayName
+			readings[name][e.DeviceID] = append(readings[name][e.DeviceID], r)
+		})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// Meters that reported nothing during the range may still have consumed
+	// energy in it, so every meter on record is looked at.
+	locationDevices, err := getLocationDevices(stub, locationId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, device := range locationDevices {
+		if _, ok := devices[device.DeviceID]; ok {
+			continue
+		}
+		record, found, err := getDeviceRecord(stub, device.DeviceID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if found && (record.Capabilities["power"] != "" || record.Capabilities["energy"] != "") {
+			devices[device.DeviceID] = &deviceEnergy{DeviceID: device.DeviceID, DisplayName: device.Latest.DisplayName, byPeriod: map[string]*energyPeriod{}}
+		}
+	}
+
+	report := energyReport{
+		LocationID: locationId,
+		From:       from,
+		To:         to,
+		Period:     period,
+		Timezone:   loc.String(),
+		Devices:    []*deviceEnergy{},
+		Totals:     []*energyPeriod{},
+	}
+	// Devices are visited in order so totals are summed the same way on
+	// every peer.
+	var deviceIDs []string
+	for deviceID := range devices {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Strings(deviceIDs)
+
+	last, _ := parseEventTime(to)
+	before := start.Add(-time.Millisecond).Format(eventTimeLayout)
+	after := last.Add(time.Millisecond).Format(eventTimeLayout)
+	totals := &deviceEnergy{byPeriod: map[string]*energyPeriod{}}
+	for _, deviceID := range deviceIDs {
+		d := devices[deviceID]
+		for _, name := range energyCapabilities {
+			// The reading in force when the range starts, and for energy
+			// the first one after it ends, bound the intervals spanning
+			// its ends.
+			values := []string{locationId, deviceID, name}
+			series := readings[name][deviceID]
+			err := readEnergy(stub, details, readingQuery.lastQueryString(values, before), name, func(e event, r energyReading) {
+				series = append([]energyReading{r}, series...)
+			})
+			if err == nil && name == "energy" {
+				err = readEnergy(stub, details, readingQuery.firstQueryString(values, after), name, func(e event, r energyReading) {
+					series = append(series, r)
+				})
+			}
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			readings[name][deviceID] = series
+		}
+
+		var intervals []energyInterval
+		if series := readings["energy"][deviceID]; len(series) > 0 {
+			d.Method = "energy"
+			intervals = energyIntervals(series)
+		} else {
+			d.Method = "power"
+			intervals = powerIntervals(readings["power"][deviceID], end)
+		}
+		for _, interval := range intervals {
+			interval, ok := interval.clip(start, end)
+			if !ok {
+				continue
+			}
+			if interval.reset {
+				d.Resets++
+			}
+			d.spread(interval.from, interval.to, loc, period, config, interval.kWh)
+			totals.spread(interval.from, interval.to, loc, period, config, interval.kWh)
+		}
+		d.Periods = sortedPeriods(d.byPeriod)
+		report.Devices = append(report.Devices, d)
+	}
+	report.Totals = sortedPeriods(totals.byPeriod)
+	for _, p := range report.Totals {
+		report.KWh += p.KWh
+		report.Cost += p.Cost
+	}
+
+	return successJSON(report)
+}
+
+// readEnergy calls visit with the power readings in kW or energy readings
+// in kWh returned by a rich query. Events whose value is not a reading in
+// a known unit are skipped.
+func readEnergy(stub shim.ChaincodeStubInterface, details *detailsReader, queryString, name string, visit func(e event, r energyReading)) error {
+	unit := "kWh"
+	if name == "power" {
+		unit = "kW"
+	}
+	var mergeErr error
+	err := getEvents(stub, queryString, func(key string, e event) bool {
+		if mergeErr = details.merge(key, &e); mergeErr != nil {
+			return false
+		}
+		at, err := parseEventTime(e.Time)
+		if err != nil {
+			return true
+		}
+		if value, ok := e.valueIn(unit); ok {
+			visit(e, energyReading{at, value})
+		}
+		return true
+	})
+	if err == nil {
+		err = mergeErr
+	}
+	return err
+}
+
+// sortedPeriods returns the periods in time order.
+func sortedPeriods(byPeriod map[string]*energyPeriod) []*energyPeriod {
+	periods := []*energyPeriod{}
+	for _, p := range byPeriod {
+		periods = append(periods, p)
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i].Period < periods[j].Period })
+	return periods
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func energyTime(hour, minute int) time.Time {
+	return time.Date(2018, 8, 15, hour, minute, 0, 0, time.UTC)
+}
+
+func TestEnergyIntervals(t *testing.T) {
+	readings := []energyReading{{energyTime(10, 0), 10}, {energyTime(12, 0), 12}, {energyTime(13, 0), 1}, {energyTime(13, 0), 1.5}}
+	want := []energyInterval{
+		{energyTime(10, 0), energyTime(12, 0), 2, false},
+		{energyTime(12, 0), energyTime(13, 0), 1, true},
+		{energyTime(13, 0), energyTime(13, 0), 0.5, false},
+	}
+	got := energyIntervals(readings)
+	if len(got) != len(want) {
+		t.Fatalf("energyIntervals = %+v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("interval %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if got := energyIntervals(readings[:1]); len(got) != 0 {
+		t.Errorf("energyIntervals of one reading = %+v", got)
+	}
+}
+
+func TestPowerIntervals(t *testing.T) {
+	readings := []energyReading{{energyTime(10, 0), 2}, {energyTime(10, 30), 1}, {energyTime(10, 30), 4}, {energyTime(12, 0), 0}}
+	want := []energyInterval{
+		{energyTime(10, 0), energyTime(10, 30), 1, false},
+		{energyTime(10, 30), energyTime(12, 0), 6, false},
+		{energyTime(12, 0), energyTime(14, 0), 0, false},
+	}
+	got := powerIntervals(readings, energyTime(14, 0))
+	if len(got) != len(want) {
+		t.Fatalf("powerIntervals = %+v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("interval %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if got := powerIntervals(readings[3:], energyTime(11, 0)); len(got) != 0 {
+		t.Errorf("powerIntervals past end = %+v", got)
+	}
+}
+
+func TestClip(t *testing.T) {
+	interval := energyInterval{from: energyTime(22, 0), to: energyTime(26, 0), kWh: 4}
+	tests := []struct {
+		name       string
+		interval   energyInterval
+		start, end time.Time
+		ok         bool
+		from, to   time.Time
+		kWh        float64
+	}{
+		{"inside", interval, energyTime(0, 0), energyTime(48, 0), true, energyTime(22, 0), energyTime(26, 0), 4},
+		{"end of day", interval, energyTime(0, 0), energyTime(24, 0), true, energyTime(22, 0), energyTime(24, 0), 2},
+		{"start of day", interval, energyTime(24, 0), energyTime(48, 0), true, energyTime(24, 0), energyTime(26, 0), 2},
+		{"both ends", interval, energyTime(23, 0), energyTime(24, 0), true, energyTime(23, 0), energyTime(24, 0), 1},
+		{"before", interval, energyTime(27, 0), energyTime(48, 0), false, time.Time{}, time.Time{}, 0},
+		{"touching", interval, energyTime(0, 0), energyTime(22, 0), false, time.Time{}, time.Time{}, 0},
+		{"instant at start", energyInterval{from: energyTime(24, 0), to: energyTime(24, 0), kWh: 1}, energyTime(24, 0), energyTime(48, 0), true, energyTime(24, 0), energyTime(24, 0), 1},
+		{"instant at end", energyInterval{from: energyTime(24, 0), to: energyTime(24, 0), kWh: 1}, energyTime(0, 0), energyTime(24, 0), false, time.Time{}, time.Time{}, 0},
+	}
+	for _, tt := range tests {
+		got, ok := tt.interval.clip(tt.start, tt.end)
+		if ok != tt.ok {
+			t.Errorf("%s: clip reported %v", tt.name, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if !got.from.Equal(tt.from) || !got.to.Equal(tt.to) || math.Abs(got.kWh-tt.kWh) > 1e-9 {
+			t.Errorf("%s: clip = %+v", tt.name, got)
+		}
+	}
+}
+
+func TestClippedDaysAddUp(t *testing.T) {
+	intervals := energyIntervals([]energyReading{{energyTime(20, 0), 3}, {energyTime(23, 0), 5}, {energyTime(25, 30), 8}, {energyTime(40, 0), 8.5}})
+	var days [2]float64
+	for i, day := range [][2]time.Time{{energyTime(0, 0), energyTime(24, 0)}, {energyTime(24, 0), energyTime(48, 0)}} {
+		for _, interval := range intervals {
+			if clipped, ok := interval.clip(day[0], day[1]); ok {
+				days[i] += clipped.kWh
+			}
+		}
+	}
+	if math.Abs(days[0]+days[1]-5.5) > 1e-9 || math.Abs(days[0]-3.2) > 1e-9 {
+		t.Errorf("days = %v, want 3.2 and 2.3", days)
+	}
+}
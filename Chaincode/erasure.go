@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// defaultBatchSize is how many records a batched maintenance call deletes
+// or rewrites when no batch size is given.
+const defaultBatchSize = 100
+
+// locationKeyTypes are the composite key types keyed by locationId that
+// eraseLocationData deletes. Seals, which only hold hashes and keys, and
+// erasure records themselves are kept.
+var locationKeyTypes = []string{
+	"timezone", "tariffs", "inactivity", "signing", "encryption", "privacy", "retention", "owner", "hubkey", "mode",
+	"rules", "rulestates", "rulehit", "incident", "automation", "occupancy", "opensession", "session",
+}
+
+// deviceKeyTypes are the composite key types keyed by deviceId that
+// eraseLocationData deletes for the devices of a location. None are written
+// for location events, whose deviceId all locations share. Chain links and
+// heads, keyed by locationId and deviceId, are kept for every device: they
+// hold nothing but hashes and keys, and are needed to verify the
+// tombstones. Rename and health records are no longer written, but devices
+// may still have them from before.
+var deviceKeyTypes = []string{"device", "rename", "battery", "health", "interval", "openincident", "summary"}
+
+// tombstone replaces an erased, expired or compacted Event. Reason is
+// "erased", "expired" or "compacted". It keeps the event's place in the
+// device's hash chain and day seal, so both can still be verified, but
+// none of its content. ContentHash is the hash the chain recorded and
+// LeafHash the leaf its day seal was built from.
+type tombstone struct {
+	DocType     string `json:"docType"`
+	Reason      string `json:"reason"`
+	ErasureID   string `json:"erasureId,omitempty"`
+	Time        string `json:"time"`
+	Seq         int64  `json:"seq,omitempty"`
+	PrevHash    string `json:"prevHash,omitempty"`
+	ContentHash string `json:"contentHash"`
+	LeafHash    string `json:"leafHash"`
+}
+
+// tombstoneEvent replaces the event stored under key with a tombstone and
+// deletes its private details.
+func tombstoneEvent(stub shim.ChaincodeStubInterface, key string, e event, reason, erasureID string) (tombstone, error) {
+	tomb := tombstone{
+		DocType:     "Tombstone",
+		Reason:      reason,
+		ErasureID:   erasureID,
+		Time:        e.Time,
+		Seq:         e.Seq,
+		PrevHash:    e.PrevHash,
+		ContentHash: e.hash(),
+		LeafHash:    hex.EncodeToString(merkleLeaf(e.canonicalJSON())),
+	}
+	if err := putStateJSON(stub, key, tomb); err != nil {
+		return tomb, err
+	}
+	if e.DetailsCollection != "" {
+		if err := stub.DelPrivateData(e.DetailsCollection, key); err != nil {
+			return tomb, err
+		}
+	}
+	return tomb, nil
+}
+
+// getTombstone loads the tombstone an erased event left behind.
+func getTombstone(stub shim.ChaincodeStubInterface, key string) (tombstone, error) {
+	var tomb tombstone
+	_, err := getStateJSON(stub, key, &tomb)
+	return tomb, err
+}
+
+// storedHash returns the chain hash of a record read from a combined key:
+// the hash of the event, or the hash kept by its tombstone once erased.
+func storedHash(stub shim.ChaincodeStubInterface, key string, e event) (string, error) {
+	if e.DocType != "Tombstone" {
+		return e.hash(), nil
+	}
+	tomb, err := getTombstone(stub, key)
+	return tomb.ContentHash, err
+}
+
+// erasureReceipt records who asked for a location's data to be erased and
+// when, stored once under the erasure composite key of locationId and
+// erasureId, the ID of the transaction that started the erasure.
+type erasureReceipt struct {
+	DocType     string `json:"docType"`
+	ErasureID   string `json:"erasureId"`
+	LocationID  string `json:"locationId"`
+	RequestedAt string `json:"requestedAt"`
+	RequestedBy actor  `json:"requestedBy"`
+}
+
+// erasureProgress tracks an erasure across batches, stored under the
+// erasureprogress composite key of locationId. Digest is a running hash
+// over the key and content hash of every record erased, so the receipt
+// commits to exactly what was removed.
+type erasureProgress struct {
+	DocType     string `json:"docType"`
+	ErasureID   string `json:"erasureId"`
+	LocationID  string `json:"locationId"`
+	Batches     int    `json:"batches"`
+	Tombstoned  int    `json:"tombstoned"`
+	Deleted     int    `json:"deleted"`
+	Digest      string `json:"digest"`
+	Done        bool   `json:"done"`
+	CompletedAt string `json:"completedAt,omitempty"`
+}
+
+// parseBatchSize reads an optional batch size argument.
+func parseBatchSize(arg string) (int, error) {
+	if arg == "" {
+		return defaultBatchSize, nil
+	}
+	batchSize, err := strconv.Atoi(arg)
+	if err != nil || batchSize < 1 || batchSize > maxPageSize {
+		return 0, fmt.Errorf("batch size must be a number between 1 and %d", maxPageSize)
+	}
+	return batchSize, nil
+}
+
+// eraser erases records within a batch budget and keeps the digest.
+type eraser struct {
+	stub      shim.ChaincodeStubInterface
+	progress  *erasureProgress
+	remaining int
+}
+
+// note adds an erased record to the digest.
+func (er *eraser) note(key string, contentHash string) {
+	sum := sha256.Sum256([]byte(er.progress.Digest + "\x00" + key + "\x00" + contentHash))
+	er.progress.Digest = hex.EncodeToString(sum[:])
+	er.remaining--
+}
+
+// delete deletes a record.
+func (er *eraser) delete(key string, value []byte) error {
+	if err := er.stub.DelState(key); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(value)
+	er.note(key, hex.EncodeToString(sum[:]))
+	er.progress.Deleted++
+	return nil
+}
+
+// deleteByPartialKey deletes the records under a partial composite key
+// until the budget runs out.
+func (er *eraser) deleteByPartialKey(objectType string, attributes []string) error {
+	resultsIterator, err := er.stub.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for er.remaining > 0 && resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		if err := er.delete(queryResponse.Key, queryResponse.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tombstoneEvents replaces the location's events with tombstones and
+// deletes their private details.
+func (er *eraser) tombstoneEvents(locationId string) error {
+	queryString := timelineQuery.rangeQueryString([]string{locationId}, "", "", nil, nil)
+	resultsIterator, err := er.stub.GetQueryResult(queryString)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for er.remaining > 0 && resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		var e event
+		if err := json.Unmarshal(queryResponse.Value, &e); err != nil {
+			return err
+		}
+		tomb, err := tombstoneEvent(er.stub, queryResponse.Key, e, "erased", er.progress.ErasureID)
+		if err != nil {
+			return err
+		}
+		er.note(queryResponse.Key, tomb.ContentHash)
+		er.progress.Tombstoned++
+	}
+	return nil
+}
+
+// eraseDevices deletes the records of the location's devices, each
+// device's latest state last so that an interrupted device is found again
+// by the next batch.
+func (er *eraser) eraseDevices(locationId string) error {
+	devices, err := getLocationDevices(er.stub, locationId)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		// The latest state of location events is only found here while
+		// it is this location's.
+		if device.DeviceID != locationDeviceID {
+			for _, objectType := range deviceKeyTypes {
+				if err := er.deleteByPartialKey(objectType, []string{device.DeviceID}); err != nil {
+					return err
+				}
+			}
+		}
+		if er.remaining <= 0 {
+			return nil
+		}
+		latest, err := json.Marshal(device.Latest)
+		if err != nil {
+			return err
+		}
+		if err := er.delete(device.DeviceID, latest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eraseLocationData erases a household's data: its events are replaced by
+// tombstones keeping only their hashes, and its devices' latest states,
+// device records, settings, registries and derived records are deleted.
+// Each call handles at most batchSize records; call again until the
+// response reports done. The first call writes an immutable receipt of who
+// requested the erasure and when. Only administrators may call it.
+// Args: locationId and optionally batchSize.
+func (t *SimpleAsset) eraseLocationData(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and optionally batchSize")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	locationId := args[0]
+	batchSize := defaultBatchSize
+	if len(args) == 2 {
+		var err error
+		if batchSize, err = parseBatchSize(args[1]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	progressKey, err := stub.CreateCompositeKey("erasureprogress", []string{locationId})
+	if err != nil {
+		return shim.Error("Failed to set composite key")
+	}
+	var progress erasureProgress
+	found, err := getStateJSON(stub, progressKey, &progress)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found || progress.Done {
+		by, err := getActor(stub)
+		if err != nil {
+			return shim.Error("Failed to get submitter identity: " + err.Error())
+		}
+		receipt := erasureReceipt{
+			DocType:     "ErasureReceipt",
+			ErasureID:   stub.GetTxID(),
+			LocationID:  locationId,
+			RequestedAt: now.Format(eventTimeLayout),
+			RequestedBy: by,
+		}
+		receiptKey, err := stub.CreateCompositeKey("erasure", []string{locationId, receipt.ErasureID})
+		if err != nil {
+			return shim.Error("Failed to set composite key")
+		}
+		if err := putStateJSON(stub, receiptKey, receipt); err != nil {
+			return shim.Error("Failed to set erasure receipt")
+		}
+		progress = erasureProgress{DocType: "ErasureProgress", ErasureID: receipt.ErasureID, LocationID: locationId}
+	}
+
+	er := &eraser{stub: stub, progress: &progress, remaining: batchSize}
+	if err := er.tombstoneEvents(locationId); err != nil {
+		return shim.Error("Failed to erase events: " + err.Error())
+	}
+	if er.remaining > 0 {
+		if err := er.eraseDevices(locationId); err != nil {
+			return shim.Error("Failed to erase devices: " + err.Error())
+		}
+	}
+	for _, objectType := range locationKeyTypes {
+		if er.remaining <= 0 {
+			break
+		}
+		if err := er.deleteByPartialKey(objectType, []string{locationId}); err != nil {
+			return shim.Error("Failed to erase " + objectType + ": " + err.Error())
+		}
+	}
+
+	progress.Batches++
+	// A batch that used less than its budget found nothing left to erase.
+	if er.remaining > 0 {
+		progress.Done = true
+		progress.CompletedAt = now.Format(eventTimeLayout)
+	}
+	if err := putStateJSON(stub, progressKey, progress); err != nil {
+		return shim.Error("Failed to set erasure progress")
+	}
+	return successJSON(progress)
+}
+
+// getErasureReceipts returns the erasure receipts of a location with the
+// progress of the latest erasure.
+// Args: locationId.
+func (t *SimpleAsset) getErasureReceipts(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("erasure", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	response := struct {
+		Receipts []erasureReceipt `json:"receipts"`
+		Latest   *erasureProgress `json:"latest"`
+	}{Receipts: []erasureReceipt{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var receipt erasureReceipt
+		if err := json.Unmarshal(queryResponse.Value, &receipt); err != nil {
+			return shim.Error(err.Error())
+		}
+		response.Receipts = append(response.Receipts, receipt)
+	}
+
+	progressKey, err := stub.CreateCompositeKey("erasureprogress", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var progress erasureProgress
+	found, err := getStateJSON(stub, progressKey, &progress)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if found {
+		response.Latest = &progress
+	}
+	return successJSON(response)
+}
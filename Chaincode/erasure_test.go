@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestParseBatchSize(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want int
+		ok   bool
+	}{
+		{"", defaultBatchSize, true},
+		{"1", 1, true},
+		{"25", 25, true},
+		{"0", 0, false},
+		{"-3", 0, false},
+		{"ten", 0, false},
+		{"100000", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseBatchSize(tt.arg)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseBatchSize(%q) = %d, %v", tt.arg, got, err)
+		}
+	}
+}
+
+func TestEraserDigest(t *testing.T) {
+	digest := func(records ...[2]string) string {
+		er := &eraser{progress: &erasureProgress{}, remaining: len(records)}
+		for _, r := range records {
+			er.note(r[0], r[1])
+		}
+		if er.remaining != 0 {
+			t.Errorf("note left %d of the budget", er.remaining)
+		}
+		return er.progress.Digest
+	}
+	a, b := [2]string{"k1", "h1"}, [2]string{"k2", "h2"}
+	if digest(a, b) != digest(a, b) {
+		t.Error("digest is not deterministic")
+	}
+	if digest(a, b) == digest(b, a) {
+		t.Error("digest ignores the order records were erased in")
+	}
+	if digest(a) == digest([2]string{"k1", "h2"}) {
+		t.Error("digest ignores the content hash")
+	}
+}
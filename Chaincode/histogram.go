@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// histogramBuckets labels the buckets of each histogram dimension.
+var histogramBuckets = map[string][]string{
+	"hour": {"00", "01", "02", "03", "04", "05", "06", "07", "08", "09", "10", "11",
+		"12", "13", "14", "15", "16", "17", "18", "19", "20", "21", "22", "23"},
+	"day": {"sun", "mon", "tue", "wed", "thu", "fri", "sat"},
+}
+
+// activityHistogramReport is the response of activityHistogram. Counts
+// holds, per capability, the number of events in each bucket, aligned with
+// Buckets; Total sums them across capabilities.
+type activityHistogramReport struct {
+	ID         string           `json:"id"`
+	Scope      string           `json:"scope"`
+	LocationID string           `json:"locationId"`
+	From       string           `json:"from"`
+	To         string           `json:"to"`
+	Dimension  string           `json:"dimension"`
+	Timezone   string           `json:"timezone"`
+	Buckets    []string         `json:"buckets"`
+	Counts     map[string][]int `json:"counts"`
+	Total      []int            `json:"total"`
+}
+
+// activityHistogram counts the events of a location or of a single device
+// between two times by hour of day or by day of week, in the location's
+// timezone, per capability.
+// Args: locationId or deviceId, from, to, dimension ("hour" or "day").
+func (t *SimpleAsset) activityHistogram(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId or deviceId, from, to and dimension")
+	}
+
+	id := args[0]
+	from, err := normalizeTime(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := normalizeTime(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	dimension := strings.ToLower(args[3])
+	buckets, ok := histogramBuckets[dimension]
+	if !ok {
+		return shim.Error("dimension must be hour or day")
+	}
+
+	// Devices have their latest state stored under their id; anything else
+	// is taken to be a location.
+	report := activityHistogramReport{ID: id, Scope: "location", LocationID: id, From: from, To: to, Dimension: dimension, Buckets: buckets, Counts: map[string][]int{}, Total: make([]int, len(buckets))}
+	latest, err := stub.GetState(id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if latest != nil {
+		var device eventLess
+		if err := json.Unmarshal(latest, &device); err != nil {
+			return shim.Error(err.Error())
+		}
+		report.Scope = "device"
+		report.LocationID = device.LocationID
+	}
+	loc, err := getLocationTimezone(stub, report.LocationID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	report.Timezone = loc.String()
+
+	count := func(key string, e event) bool {
+		at, err := parseEventTime(e.Time)
+		if err != nil {
+			return true
+		}
+		bucket := histogramBucket(at.In(loc), dimension)
+		if _, ok := report.Counts[e.Name]; !ok {
+			report.Counts[e.Name] = make([]int, len(buckets))
+		}
+		report.Counts[e.Name][bucket]++
+		report.Total[bucket]++
+		return true
+	}
+	queryString := timelineQuery.rangeQueryString([]string{id}, from, to, nil, nil)
+	if report.Scope == "device" {
+		queryString = deviceQuery.rangeQueryString([]string{report.LocationID, id}, from, to, nil, nil)
+	}
+	err = getEvents(stub, queryString, count)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return successJSON(report)
+}
+
+// histogramBucket returns the bucket local time t falls into: its hour of
+// the day or its day of the week, Sunday first.
+func histogramBucket(t time.Time, dimension string) int {
+	if dimension == "hour" {
+		return t.Hour()
+	}
+	return int(t.Weekday())
+}
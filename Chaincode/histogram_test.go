@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogramBucket(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	// 2018-08-19 was a Sunday.
+	at := time.Date(2018, 8, 19, 2, 30, 0, 0, time.UTC)
+	tests := []struct {
+		t         time.Time
+		dimension string
+		want      int
+	}{
+		{at, "hour", 2},
+		{at, "day", 0},
+		{at.In(newYork), "hour", 22},
+		{at.In(newYork), "day", 6},
+	}
+	for _, tt := range tests {
+		if got := histogramBucket(tt.t, tt.dimension); got != tt.want {
+			t.Errorf("histogramBucket(%s, %s) = %d, want %d", tt.t, tt.dimension, got, tt.want)
+		}
+		if got := histogramBucket(tt.t, tt.dimension); got >= len(histogramBuckets[tt.dimension]) {
+			t.Errorf("bucket %d has no label", got)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// actor identifies the client that submitted a transaction.
+type actor struct {
+	MSPID string `json:"mspId"`
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+}
+
+// getActor returns the identity of the transaction submitter. Name is the
+// common name of its certificate.
+func getActor(stub shim.ChaincodeStubInterface) (actor, error) {
+	var a actor
+	var err error
+	if a.MSPID, err = cid.GetMSPID(stub); err != nil {
+		return a, err
+	}
+	if a.ID, err = cid.GetID(stub); err != nil {
+		return a, err
+	}
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return a, err
+	}
+	if cert != nil {
+		a.Name = cert.Subject.CommonName
+	}
+	return a, nil
+}
+
+// adminAttribute is the certificate attribute that lets a client manage the
+// hub keys and policies of locations. Enroll administrators with it set to
+// "true", e.g. fabric-ca-client register --id.attrs 'smartthings.admin=true:ecert'.
+const adminAttribute = "smartthings.admin"
+
+// isAdmin reports whether the submitter's certificate carries
+// adminAttribute set to "true".
+func isAdmin(stub shim.ChaincodeStubInterface) (bool, error) {
+	value, found, err := cid.GetAttributeValue(stub, adminAttribute)
+	if err != nil {
+		return false, err
+	}
+	return found && value == "true", nil
+}
+
+// requireAdmin returns an error unless the submitter is an administrator
+// (see isAdmin).
+func requireAdmin(stub shim.ChaincodeStubInterface) error {
+	admin, err := isAdmin(stub)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return errors.New("submitter is not allowed to manage locations, its certificate lacks " + adminAttribute + "=true")
+	}
+	return nil
+}
+
+// requireAdminOrOwner returns an error unless the submitter is an
+// administrator or the owner of the location (see setLocationOwner), and
+// reports whether it is an administrator.
+func requireAdminOrOwner(stub shim.ChaincodeStubInterface, locationId string) (bool, error) {
+	admin, err := isAdmin(stub)
+	if err != nil || admin {
+		return admin, err
+	}
+	owner, found, err := getLocationOwner(stub, locationId)
+	if err != nil {
+		return false, err
+	}
+	by, err := getActor(stub)
+	if err != nil {
+		return false, err
+	}
+	if !found || by.MSPID != owner.MSPID || by.ID != owner.ID {
+		return false, errors.New("submitter is neither an administrator nor the owner of location " + locationId)
+	}
+	return false, nil
+}
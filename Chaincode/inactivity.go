@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// inactivitySignals are the capabilities whose events show someone is
+// moving about the home, with the filters their events have to pass. Only
+// motion going active counts, any contact change does and switch changes
+// only when made by hand, since automations switch lights in empty homes.
+// Recorded is set for the capabilities whose last report in the device
+// records can stand in for an activity; the records do not tell whether a
+// switch was flipped by hand.
+var inactivitySignals = []struct {
+	name     string
+	filters  []queryFilter
+	recorded bool
+}{
+	{"motion", []queryFilter{{field: "value", value: "active", hidden: true}}, true},
+	{"contact", nil, true},
+	{"switch", []queryFilter{{field: "isPhysical", value: "true", hidden: true}}, false},
+}
+
+// inactivityPolicy is how long a location may go without activity, stored
+// under the inactivity composite key of locationId. Time inside a sleep
+// window does not count towards the gap.
+type inactivityPolicy struct {
+	DocType      string        `json:"docType"`
+	LocationID   string        `json:"locationId"`
+	MaxGap       string        `json:"maxGap"`
+	SleepWindows []dailyWindow `json:"sleepWindows"`
+
+	maxGap time.Duration
+}
+
+// lastActivity is the event a gap is measured from.
+type lastActivity struct {
+	Key         string `json:"key,omitempty"`
+	Time        string `json:"time"`
+	DeviceID    string `json:"deviceId"`
+	DisplayName string `json:"displayName"`
+	Name        string `json:"name"`
+	Value       string `json:"value,omitempty"`
+}
+
+// inactivityReport is the response of checkInactivity. Gap is the wall
+// clock time since the last activity and AwakeGap the part of it outside
+// sleep windows, which is what the policy is checked against. LastActivity
+// is nil when the location has no activity on record before asOf.
+type inactivityReport struct {
+	LocationID      string        `json:"locationId"`
+	AsOf            string        `json:"asOf"`
+	Timezone        string        `json:"timezone"`
+	MaxGap          string        `json:"maxGap"`
+	LastActivity    *lastActivity `json:"lastActivity"`
+	Gap             string        `json:"gap"`
+	GapSeconds      int64         `json:"gapSeconds"`
+	AwakeGap        string        `json:"awakeGap"`
+	AwakeGapSeconds int64         `json:"awakeGapSeconds"`
+	InSleepWindow   bool          `json:"inSleepWindow"`
+	Breached        bool          `json:"breached"`
+}
+
+// setInactivityPolicy stores the inactivity policy of a location.
+// Args: locationId, policy as JSON, e.g.
+// {"maxGap":"6h","sleepWindows":[{"start":"22:00","end":"08:00"}]}
+func (t *SimpleAsset) setInactivityPolicy(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and policy")
+	}
+
+	var policy inactivityPolicy
+	if err := json.Unmarshal([]byte(args[1]), &policy); err != nil {
+		return shim.Error("invalid policy: " + err.Error())
+	}
+	policy.DocType = "InactivityPolicy"
+	policy.LocationID = args[0]
+	if err := policy.validate(); err != nil {
+		return shim.Error(err.Error())
+	}
+	policy.MaxGap = policy.maxGap.String()
+
+	key, err := stub.CreateCompositeKey("inactivity", []string{policy.LocationID})
+	if err != nil {
+		return shim.Error("Failed to set composite key")
+	}
+	if err := putStateJSON(stub, key, policy); err != nil {
+		return shim.Error("Failed to set inactivity policy")
+	}
+	return successJSON(policy)
+}
+
+// getInactivityPolicy returns the inactivity policy of a location.
+// Args: locationId.
+func (t *SimpleAsset) getInactivityPolicy(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId")
+	}
+
+	policy, found, err := loadInactivityPolicy(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("No inactivity policy for location " + args[0])
+	}
+	return successJSON(policy)
+}
+
+// loadInactivityPolicy loads and validates the policy of a location.
+func loadInactivityPolicy(stub shim.ChaincodeStubInterface, locationId string) (inactivityPolicy, bool, error) {
+	var policy inactivityPolicy
+	key, err := stub.CreateCompositeKey("inactivity", []string{locationId})
+	if err != nil {
+		return policy, false, err
+	}
+	found, err := getStateJSON(stub, key, &policy)
+	if err != nil || !found {
+		return policy, found, err
+	}
+	return policy, true, policy.validate()
+}
+
+// validate checks the policy and resolves its gap and sleep windows.
+func (p *inactivityPolicy) validate() error {
+	var err error
+	if p.maxGap, err = time.ParseDuration(p.MaxGap); err != nil || p.maxGap <= 0 {
+		return fmt.Errorf("maxGap must be a positive duration such as 6h")
+	}
+	if p.SleepWindows == nil {
+		p.SleepWindows = []dailyWindow{}
+	}
+	for i := range p.SleepWindows {
+		if err := p.SleepWindows[i].resolve(); err != nil {
+			return fmt.Errorf("sleep window %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// asleep reports whether local time t is inside a sleep window.
+func (p inactivityPolicy) asleep(t time.Time) bool {
+	for _, w := range p.SleepWindows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// awakeTime returns how much of the time between from and to falls
+// outside the sleep windows, in the location's timezone.
+func (p inactivityPolicy) awakeTime(from, to time.Time, loc *time.Location) time.Duration {
+	var awake time.Duration
+	for cur := from.In(loc); cur.Before(to); {
+		next := nextEdge(cur, p.SleepWindows)
+		if next.After(to) {
+			next = to.In(loc)
+		}
+		if !p.asleep(cur) {
+			awake += next.Sub(cur)
+		}
+		cur = next
+	}
+	return awake
+}
+
+// checkInactivity reports the last motion, contact or manual switch
+// activity of a location before asOf, how long ago it was and whether the gap, not
+// counting sleep windows, breaches the location's inactivity policy.
+// Args: locationId and optionally asOf, which defaults to the transaction
+// time.
+func (t *SimpleAsset) checkInactivity(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and optionally asOf")
+	}
+
+	locationId := args[0]
+	asOf, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) == 2 && args[1] != "" {
+		normalized, err := normalizeTime(args[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		asOf, _ = parseEventTime(normalized)
+	}
+
+	policy, found, err := loadInactivityPolicy(stub, locationId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("No inactivity policy for location " + locationId)
+	}
+	loc, err := getLocationTimezone(stub, locationId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Only the recent past is searched: a day beyond the policy's gap is
+	// enough to cover a night of sleep windows. Older activity is taken from
+	// the device records.
+	to := asOf.Format(eventTimeLayout)
+	since := asOf.Add(-policy.maxGap - 24*time.Hour)
+	var last *lastActivity
+	for _, signal := range inactivitySignals {
+		queryString := capabilityQuery.rangeQueryString([]string{locationId, signal.name}, since.Format(eventTimeLayout), to, signal.filters, nil)
+		err := getMergedEvents(stub, queryString, signal.filters, func(key string, e event) bool {
+			if last == nil || e.Time > last.Time {
+				last = &lastActivity{Key: key, Time: e.Time, DeviceID: e.DeviceID, DisplayName: e.DisplayName, Name: e.Name, Value: e.Value}
+			}
+			return true
+		})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if last == nil {
+		if last, err = lastRecordedActivity(stub, locationId, since.Format(eventTimeLayout)); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	report := inactivityReport{
+		LocationID:    locationId,
+		AsOf:          to,
+		Timezone:      loc.String(),
+		MaxGap:        policy.MaxGap,
+		LastActivity:  last,
+		InSleepWindow: policy.asleep(asOf.In(loc)),
+	}
+	from := since
+	if last != nil {
+		from, _ = parseEventTime(last.Time)
+	}
+	gap := asOf.Sub(from)
+	awake := policy.awakeTime(from, asOf, loc)
+	report.Gap = gap.Truncate(time.Second).String()
+	report.GapSeconds = int64(gap / time.Second)
+	report.AwakeGap = awake.Truncate(time.Second).String()
+	report.AwakeGapSeconds = int64(awake / time.Second)
+	report.Breached = awake > policy.maxGap
+
+	return successJSON(report)
+}
+
+// lastRecordedActivity looks up the latest activity of a location before
+// the given time in its device records, which keep the last time each
+// capability reported. Records updated since then cannot tell what came
+// before, so nil is returned for them.
+func lastRecordedActivity(stub shim.ChaincodeStubInterface, locationId, before string) (*lastActivity, error) {
+	devices, err := getLocationDevices(stub, locationId)
+	if err != nil {
+		return nil, err
+	}
+	var last *lastActivity
+	for _, device := range devices {
+		record, found, err := getDeviceRecord(stub, device.DeviceID)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		for _, signal := range inactivitySignals {
+			at, ok := record.Capabilities[signal.name]
+			if signal.recorded && ok && at < before && (last == nil || at > last.Time) {
+				last = &lastActivity{Time: at, DeviceID: record.DeviceID, DisplayName: device.Latest.DisplayName, Name: signal.name}
+			}
+		}
+	}
+	return last, nil
+}
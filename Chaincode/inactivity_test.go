@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAwakeTime(t *testing.T) {
+	policy := inactivityPolicy{MaxGap: "4h", SleepWindows: []dailyWindow{{Start: "22:00", End: "08:00"}}}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	day := func(hour int) time.Time {
+		return time.Date(2018, 8, 15, hour, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name     string
+		from, to time.Time
+		loc      *time.Location
+		want     time.Duration
+	}{
+		{"awake", day(9), day(12), time.UTC, 3 * time.Hour},
+		{"asleep", day(23), day(31), time.UTC, 0},
+		{"overnight", day(21), day(33), time.UTC, 2 * time.Hour},
+		{"whole day", day(0), day(24), time.UTC, 14 * time.Hour},
+		{"other timezone", day(9), day(12), time.FixedZone("UTC-2", -2*3600), 2 * time.Hour},
+		{"empty", day(12), day(12), time.UTC, 0},
+	}
+	for _, tt := range tests {
+		if got := policy.awakeTime(tt.from, tt.to, tt.loc); got != tt.want {
+			t.Errorf("%s: awakeTime = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInactivitySignals(t *testing.T) {
+	want := map[string]struct {
+		filters  []queryFilter
+		recorded bool
+	}{
+		"motion":  {[]queryFilter{{field: "value", value: "active", hidden: true}}, true},
+		"contact": {nil, true},
+		"switch":  {[]queryFilter{{field: "isPhysical", value: "true", hidden: true}}, false},
+	}
+	for _, signal := range inactivitySignals {
+		w, ok := want[signal.name]
+		if !ok {
+			t.Errorf("unexpected signal %s", signal.name)
+			continue
+		}
+		if !reflect.DeepEqual(signal.filters, w.filters) || signal.recorded != w.recorded {
+			t.Errorf("%s: filters %+v, recorded %v", signal.name, signal.filters, signal.recorded)
+		}
+		delete(want, signal.name)
+	}
+	for name := range want {
+		t.Errorf("missing signal %s", name)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// Incident statuses. An incident opens when a safety sensor raises an
+// alarm, may be acknowledged, and is closed by resolving it.
+const (
+	incidentOpen         = "open"
+	incidentAcknowledged = "acknowledged"
+	incidentResolved     = "resolved"
+)
+
+// safetyAlarms maps the safety capabilities to the value that raises an
+// alarm and the value that reports it cleared.
+var safetyAlarms = map[string]struct{ alarm, clear string }{
+	"smoke":          {"detected", "clear"},
+	"carbonmonoxide": {"detected", "clear"},
+	"water":          {"wet", "dry"},
+}
+
+// incidentTransition records a change to an incident: who made it and when.
+// At is the transaction time; EventKey and EventTime are set when the
+// change came from a device event.
+type incidentTransition struct {
+	Status    string `json:"status"`
+	By        actor  `json:"by"`
+	At        string `json:"at"`
+	Note      string `json:"note,omitempty"`
+	EventKey  string `json:"eventKey,omitempty"`
+	EventTime string `json:"eventTime,omitempty"`
+}
+
+// incident is a safety alarm raised by a device, stored under the incident
+// composite key of locationId and incident id. When the event that raised
+// it hides its name and value they are left empty and Hidden is set; the
+// first transition points to the event.
+type incident struct {
+	DocType     string               `json:"docType"`
+	IncidentID  string               `json:"incidentId"`
+	LocationID  string               `json:"locationId"`
+	DeviceID    string               `json:"deviceId"`
+	DisplayName string               `json:"displayName"`
+	Capability  string               `json:"capability"`
+	Value       string               `json:"value"`
+	Status      string               `json:"status"`
+	OpenedAt    string               `json:"openedAt"`
+	Cleared     bool                 `json:"cleared"`
+	Transitions []incidentTransition `json:"transitions"`
+	Hidden      bool                 `json:"hidden,omitempty"`
+}
+
+// openIncident points from a device capability to its unresolved incident,
+// stored under the openincident composite key of deviceId and capability.
+type openIncident struct {
+	DocType    string `json:"docType"`
+	LocationID string `json:"locationId"`
+	IncidentID string `json:"incidentId"`
+}
+
+// alarmState reports whether an event raises a safety alarm or reports it
+// cleared. ok is false for events that do neither.
+func alarmState(e event) (raised, ok bool) {
+	values, safety := safetyAlarms[e.Name]
+	switch {
+	case !safety:
+		return false, false
+	case e.Value == values.alarm:
+		return true, true
+	case e.Value == values.clear:
+		return false, true
+	}
+	return false, false
+}
+
+// checkTransition reports why an incident cannot move to status, if it
+// cannot. Resolved incidents stay resolved.
+func (inc incident) checkTransition(status string) error {
+	if inc.Status == incidentResolved || inc.Status == status {
+		return fmt.Errorf("incident is already %s", inc.Status)
+	}
+	return nil
+}
+
+// trackIncident is called by saveNewEvent for every stored event. An alarm
+// value from a safety capability opens an incident unless the device already
+// has one open for that capability; the matching clear value is recorded on
+// the open incident, which stays open until someone resolves it. hidden
+// is set when the stored event hides what the incident would copy.
+func trackIncident(stub shim.ChaincodeStubInterface, eventKey string, e event, hidden bool) error {
+	raised, ok := alarmState(e)
+	if !ok {
+		return nil
+	}
+
+	openKey, err := stub.CreateCompositeKey("openincident", []string{e.DeviceID, e.Name})
+	if err != nil {
+		return err
+	}
+	var open openIncident
+	isOpen, err := getStateJSON(stub, openKey, &open)
+	if err != nil {
+		return err
+	}
+	if !isOpen && !raised {
+		return nil
+	}
+
+	by, err := getActor(stub)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	transition := incidentTransition{By: by, At: now.Format(eventTimeLayout), EventKey: eventKey, EventTime: e.Time}
+
+	if isOpen {
+		if raised {
+			return nil
+		}
+		incidentKey, err := stub.CreateCompositeKey("incident", []string{open.LocationID, open.IncidentID})
+		if err != nil {
+			return err
+		}
+		var inc incident
+		if _, err := getStateJSON(stub, incidentKey, &inc); err != nil {
+			return err
+		}
+		inc.Cleared = true
+		transition.Status = inc.Status
+		transition.Note = "device reported " + e.Value
+		if hidden {
+			transition.Note = "device reported the alarm cleared"
+		}
+		inc.Transitions = append(inc.Transitions, transition)
+		return putStateJSON(stub, incidentKey, inc)
+	}
+
+	inc := incident{
+		DocType:     "Incident",
+		IncidentID:  stub.GetTxID(),
+		LocationID:  e.LocationID,
+		DeviceID:    e.DeviceID,
+		DisplayName: e.DisplayName,
+		Capability:  e.Name,
+		Value:       e.Value,
+		Status:      incidentOpen,
+		OpenedAt:    e.Time,
+	}
+	if hidden {
+		inc.DisplayName, inc.Value, inc.Hidden = "", "", true
+	}
+	transition.Status = incidentOpen
+	inc.Transitions = []incidentTransition{transition}
+	key, err := stub.CreateCompositeKey("incident", []string{inc.LocationID, inc.IncidentID})
+	if err != nil {
+		return err
+	}
+	if err := putStateJSON(stub, key, inc); err != nil {
+		return err
+	}
+	return putStateJSON(stub, openKey, openIncident{DocType: "OpenIncident", LocationID: inc.LocationID, IncidentID: inc.IncidentID})
+}
+
+// acknowledgeIncident marks an open incident as seen by someone.
+// Args: locationId, incidentId and optionally a note.
+func (t *SimpleAsset) acknowledgeIncident(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	return t.transitionIncident(stub, args, incidentAcknowledged)
+}
+
+// resolveIncident closes an incident.
+// Args: locationId, incidentId and optionally a note.
+func (t *SimpleAsset) resolveIncident(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	return t.transitionIncident(stub, args, incidentResolved)
+}
+
+// transitionIncident moves an incident to status, recording the caller and
+// the transaction time.
+func (t *SimpleAsset) transitionIncident(stub shim.ChaincodeStubInterface, args []string, status string) peer.Response {
+
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId, incidentId and optionally a note")
+	}
+
+	key, err := stub.CreateCompositeKey("incident", []string{args[0], args[1]})
+	if err != nil {
+		return shim.Error("Failed to set composite key")
+	}
+	var inc incident
+	found, err := getStateJSON(stub, key, &inc)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("incident not found")
+	}
+	if err := inc.checkTransition(status); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	by, err := getActor(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	transition := incidentTransition{Status: status, By: by, At: now.Format(eventTimeLayout)}
+	if len(args) == 3 {
+		transition.Note = args[2]
+	}
+	inc.Status = status
+	inc.Transitions = append(inc.Transitions, transition)
+	if err := putStateJSON(stub, key, inc); err != nil {
+		return shim.Error("Failed to set incident")
+	}
+
+	if status == incidentResolved {
+		openKey, err := stub.CreateCompositeKey("openincident", []string{inc.DeviceID, inc.Capability})
+		if err != nil {
+			return shim.Error("Failed to set composite key")
+		}
+		if err := stub.DelState(openKey); err != nil {
+			return shim.Error("Failed to close incident")
+		}
+	}
+	if err := newDetailsReader(stub).revealIncident(&inc); err != nil {
+		return shim.Error(err.Error())
+	}
+	return successJSON(inc)
+}
+
+// getIncident returns an incident with its full history.
+// Args: locationId, incidentId.
+func (t *SimpleAsset) getIncident(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and incidentId")
+	}
+
+	key, err := stub.CreateCompositeKey("incident", []string{args[0], args[1]})
+	if err != nil {
+		return shim.Error("Failed to set composite key")
+	}
+	var inc incident
+	found, err := getStateJSON(stub, key, &inc)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("incident not found")
+	}
+	if err := newDetailsReader(stub).revealIncident(&inc); err != nil {
+		return shim.Error(err.Error())
+	}
+	return successJSON(inc)
+}
+
+// listOpenIncidents returns the incidents of a location that are not
+// resolved yet, oldest first.
+// Args: locationId.
+func (t *SimpleAsset) listOpenIncidents(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("incident", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	details := newDetailsReader(stub)
+	incidents := []incident{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var inc incident
+		if err := json.Unmarshal(queryResponse.Value, &inc); err != nil {
+			return shim.Error(err.Error())
+		}
+		if inc.Status == incidentResolved {
+			continue
+		}
+		if err := details.revealIncident(&inc); err != nil {
+			return shim.Error(err.Error())
+		}
+		incidents = append(incidents, inc)
+	}
+	sort.Slice(incidents, func(i, j int) bool { return incidents[i].OpenedAt < incidents[j].OpenedAt })
+	return successJSON(incidents)
+}
+
+// revealIncident fills in the name and value an incident leaves out, if
+// the caller may read the event that raised it.
+func (r *detailsReader) revealIncident(inc *incident) error {
+	if !inc.Hidden || len(inc.Transitions) == 0 {
+		return nil
+	}
+	e, ok, err := r.event(inc.Transitions[0].EventKey)
+	if err != nil || !ok {
+		return err
+	}
+	inc.DisplayName, inc.Value, inc.Hidden = e.DisplayName, e.Value, false
+	return nil
+}
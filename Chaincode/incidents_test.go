@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestAlarmState(t *testing.T) {
+	tests := []struct {
+		name, value string
+		raised, ok  bool
+	}{
+		{"smoke", "detected", true, true},
+		{"smoke", "clear", false, true},
+		{"smoke", "tested", false, false},
+		{"carbonmonoxide", "detected", true, true},
+		{"water", "wet", true, true},
+		{"water", "dry", false, true},
+		{"water", "detected", false, false},
+		{"contact", "open", false, false},
+	}
+	for _, tt := range tests {
+		raised, ok := alarmState(event{Name: tt.name, Value: tt.value})
+		if raised != tt.raised || ok != tt.ok {
+			t.Errorf("alarmState(%s=%s) = %v, %v", tt.name, tt.value, raised, ok)
+		}
+	}
+}
+
+func TestCheckTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		ok       bool
+	}{
+		{incidentOpen, incidentAcknowledged, true},
+		{incidentOpen, incidentResolved, true},
+		{incidentAcknowledged, incidentResolved, true},
+		{incidentOpen, incidentOpen, false},
+		{incidentAcknowledged, incidentAcknowledged, false},
+		{incidentResolved, incidentAcknowledged, false},
+		{incidentResolved, incidentResolved, false},
+	}
+	for _, tt := range tests {
+		err := incident{Status: tt.from}.checkTransition(tt.to)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s to %s: %v", tt.from, tt.to, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// indexDir is where Fabric picks up the CouchDB index definitions.
+const indexDir = "META-INF/statedb/couchdb/indexes"
+
+// couchIndex is a CouchDB index definition as read by Fabric from
+// META-INF/statedb/couchdb/indexes.
+type couchIndex struct {
+	Index struct {
+		Fields []string `json:"fields"`
+	} `json:"index"`
+	Ddoc string `json:"ddoc"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// indexFor builds the index definition for a query shape.
+func indexFor(q queryShape) couchIndex {
+	var index couchIndex
+	index.Index.Fields = q.indexFields()
+	index.Ddoc = q.indexDoc()
+	index.Name = q.indexName()
+	index.Type = "json"
+	return index
+}
+
+// covers reports whether the index can serve every selector field of the
+// shape. CouchDB only picks an index when all of its fields appear in the
+// selector, so the index may not contain fields the shape does not match on.
+func (index couchIndex) covers(q queryShape) bool {
+	queried := map[string]bool{}
+	for _, field := range q.indexFields() {
+		queried[field] = true
+	}
+	indexed := map[string]bool{}
+	for _, field := range index.Index.Fields {
+		if !queried[field] {
+			return false
+		}
+		indexed[field] = true
+	}
+	for field := range queried {
+		if !indexed[field] {
+			return false
+		}
+	}
+	return true
+}
+
+// readIndexes loads every index definition in dir, rejecting files that do
+// not hold exactly one definition and names that are used twice.
+func readIndexes(dir string) ([]couchIndex, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var indexes []couchIndex
+	seen := map[string]string{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(strings.NewReader(string(data)))
+		var index couchIndex
+		if err := decoder.Decode(&index); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if decoder.More() {
+			return nil, fmt.Errorf("%s: more than one index definition in file", path)
+		}
+		if index.Name == "" || index.Ddoc == "" || len(index.Index.Fields) == 0 {
+			return nil, fmt.Errorf("%s: index needs a name, ddoc and fields", path)
+		}
+		key := index.Ddoc + "/" + index.Name
+		if other, ok := seen[key]; ok {
+			return nil, fmt.Errorf("%s: index %s already defined in %s", path, key, other)
+		}
+		seen[key] = path
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+// checkIndexes fails when a query shape has no covering index in dir. The
+// index has to be the one the query names in use_index, otherwise CouchDB
+// ignores the hint and may fall back to a full scan. The generator's -check
+// mode and the tests both run it.
+func checkIndexes(dir string) error {
+	indexes, err := readIndexes(dir)
+	if err != nil {
+		return err
+	}
+	byName := map[string]couchIndex{}
+	for _, index := range indexes {
+		byName[index.Ddoc+"/"+index.Name] = index
+	}
+
+	var missing []string
+	for _, q := range queryShapes {
+		index, ok := byName[q.indexDoc()+"/"+q.indexName()]
+		if !ok || !index.covers(q) {
+			missing = append(missing, fmt.Sprintf("%s query on %s (index %s)", q.docType, strings.Join(q.indexFields(), ","), q.indexName()))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("no covering index for:\n  %s\nrun go generate to update %s", strings.Join(missing, "\n  "), dir)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+//go:build indexgen
+// +build indexgen
+
+// indexgen replaces the chaincode entry point with a generator for the
+// CouchDB index definitions packaged in META-INF. Each shape in queryShapes
+// gets its own index file, as Fabric requires one index per file.
+//
+//	go run -tags indexgen . -dir META-INF/statedb/couchdb/indexes
+//
+// With -check nothing is written; instead the command fails when a query
+// shape has no covering index in the directory, or when a file there is not
+// a single valid index definition.
+//
+//	go run -tags indexgen . -dir META-INF/statedb/couchdb/indexes -check
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	dir := flag.String("dir", indexDir, "directory holding the index definitions")
+	check := flag.Bool("check", false, "verify that every query has a covering index instead of writing files")
+	flag.Parse()
+
+	var err error
+	if *check {
+		if err = checkIndexes(*dir); err == nil {
+			fmt.Printf("%d queries covered by indexes in %s\n", len(queryShapes), *dir)
+		}
+	} else {
+		err = writeIndexes(*dir)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// writeIndexes writes one index file per query shape into dir.
+func writeIndexes(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, q := range queryShapes {
+		indexJSON, err := json.MarshalIndent(indexFor(q), "", "    ")
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, q.indexName()+".json")
+		if err := ioutil.WriteFile(path, append(indexJSON, '\n'), 0644); err != nil {
+			return err
+		}
+		fmt.Println("wrote", path)
+	}
+	return nil
+}
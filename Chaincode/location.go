@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// locationTimezone is the IANA timezone of a location, used wherever
+// events are grouped by local day or time of day. Locations without one
+// are treated as UTC.
+type locationTimezone struct {
+	DocType    string `json:"docType"`
+	LocationID string `json:"locationId"`
+	Timezone   string `json:"timezone"`
+}
+
+// setLocationTimezone stores the timezone of a location. Every report
+// grouped by local time depends on it, so only administrators may call it.
+// Args: locationId, timezone, e.g. "Europe/London".
+func (t *SimpleAsset) setLocationTimezone(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and timezone")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	locationId := args[0]
+	if _, err := time.LoadLocation(args[1]); err != nil {
+		return shim.Error(fmt.Sprintf("unknown timezone %q", args[1]))
+	}
+
+	key, err := stub.CreateCompositeKey("timezone", []string{locationId})
+	if err != nil {
+		return shim.Error("Failed to set composite key")
+	}
+	tz := locationTimezone{DocType: "LocationTimezone", LocationID: locationId, Timezone: args[1]}
+	if err := putStateJSON(stub, key, tz); err != nil {
+		return shim.Error("Failed to set timezone")
+	}
+	return successJSON(tz)
+}
+
+// getLocationTimezone loads the timezone of a location, defaulting to UTC.
+func getLocationTimezone(stub shim.ChaincodeStubInterface, locationId string) (*time.Location, error) {
+	key, err := stub.CreateCompositeKey("timezone", []string{locationId})
+	if err != nil {
+		return nil, err
+	}
+	var tz locationTimezone
+	found, err := getStateJSON(stub, key, &tz)
+	if err != nil || !found {
+		return time.UTC, err
+	}
+	return time.LoadLocation(tz.Timezone)
+}
+
+// locationOwner is the client that owns a location, stored under the owner
+// composite key of locationId. It may change the location's retention (see
+// setRetention) without being an administrator.
+type locationOwner struct {
+	DocType    string `json:"docType"`
+	LocationID string `json:"locationId"`
+	MSPID      string `json:"mspId"`
+	ID         string `json:"id"`
+}
+
+// setLocationOwner sets the client that owns a location, identified by its
+// MSP ID and the ID of its certificate as the client identity library
+// returns it. Only administrators may call it.
+// Args: locationId, mspId, id.
+func (t *SimpleAsset) setLocationOwner(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId, mspId and id")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	if args[1] == "" || args[2] == "" {
+		return shim.Error("mspId and id must not be empty")
+	}
+
+	key, err := stub.CreateCompositeKey("owner", []string{args[0]})
+	if err != nil {
+		return shim.Error("Failed to set composite key")
+	}
+	owner := locationOwner{DocType: "LocationOwner", LocationID: args[0], MSPID: args[1], ID: args[2]}
+	if err := putStateJSON(stub, key, owner); err != nil {
+		return shim.Error("Failed to set owner")
+	}
+	return successJSON(owner)
+}
+
+// getLocationOwner loads the owner of a location.
+func getLocationOwner(stub shim.ChaincodeStubInterface, locationId string) (locationOwner, bool, error) {
+	var owner locationOwner
+	key, err := stub.CreateCompositeKey("owner", []string{locationId})
+	if err != nil {
+		return owner, false, err
+	}
+	found, err := getStateJSON(stub, key, &owner)
+	return owner, found, err
+}
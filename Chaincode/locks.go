@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// defaultArrivalWindow is how close to an unlock a presence arrival has to
+// be for the unlock to count as explained.
+const defaultArrivalWindow = 10 * time.Minute
+
+// lockAuditEntry is one lock or unlock with how it was done. RecordHash is
+// the SHA-256 of the event as stored on the ledger, so the entry can be
+// checked against the ledger later.
+type lockAuditEntry struct {
+	Key                 string `json:"key"`
+	Time                string `json:"time"`
+	DeviceID            string `json:"deviceId"`
+	DisplayName         string `json:"displayName"`
+	Action              string `json:"action"`
+	Method              string `json:"method"`
+	InstalledSmartAppID string `json:"installedSmartAppId,omitempty"`
+	Source              string `json:"source"`
+	IsPhysical          bool   `json:"isPhysical"`
+	IsDigital           bool   `json:"isDigital"`
+	DescriptionText     string `json:"descriptionText"`
+	ArrivalKey          string `json:"arrivalKey,omitempty"`
+	NoPresenceArrival   bool   `json:"noPresenceArrival"`
+	RecordHash          string `json:"recordHash"`
+}
+
+// lockAuditReport is the response of lockAudit.
+type lockAuditReport struct {
+	LocationID         string           `json:"locationId"`
+	From               string           `json:"from"`
+	To                 string           `json:"to"`
+	ArrivalWindow      string           `json:"arrivalWindow"`
+	Entries            []lockAuditEntry `json:"entries"`
+	UnexplainedUnlocks int              `json:"unexplainedUnlocks"`
+}
+
+// lockAudit reports every lock and unlock of a location with the method
+// used (keypad, app, manual, auto or unknown) and the SmartApp that caused
+// it. Unlocks with no presence arrival within the arrival window on either
+// side are flagged.
+// Args: locationId, from, to and optionally the arrival window, e.g. "10m".
+func (t *SimpleAsset) lockAudit(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId, from, to and optionally arrivalWindow")
+	}
+
+	locationId := args[0]
+	from, err := normalizeTime(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := normalizeTime(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	window := defaultArrivalWindow
+	if len(args) == 4 {
+		if window, err = parseWindow(args[3]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// Arrivals just outside the range can still explain an unlock inside it.
+	// Hubs repeat "present" while a sensor stays present; only the report
+	// that changed the state is an arrival.
+	start, _ := parseEventTime(from)
+	end, _ := parseEventTime(to)
+	var arrivals []presenceArrival
+	presenceFilter := []queryFilter{{field: "value", value: "present", hidden: true}, {field: "isStateChange", value: "true"}}
+	presenceQuery := capabilityQuery.rangeQueryString([]string{locationId, "presence"},
+		start.Add(-window).Format(eventTimeLayout), end.Add(window).Format(eventTimeLayout), presenceFilter, nil)
+	err = getMergedEvents(stub, presenceQuery, presenceFilter, func(key string, e event) bool {
+		if at, err := parseEventTime(e.Time); err == nil {
+			arrivals = append(arrivals, presenceArrival{key: key, at: at})
+		}
+		return true
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetQueryResult(capabilityQuery.rangeQueryString([]string{locationId, "lock"}, from, to, nil, nil))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	details := newDetailsReader(stub)
+	report := lockAuditReport{LocationID: locationId, From: from, To: to, ArrivalWindow: window.String(), Entries: []lockAuditEntry{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var e event
+		if err := json.Unmarshal(queryResponse.Value, &e); err != nil {
+			return shim.Error(err.Error())
+		}
+		hash := sha256.Sum256(queryResponse.Value)
+		if err := details.merge(queryResponse.Key, &e); err != nil {
+			return shim.Error(err.Error())
+		}
+		entry := lockAuditEntry{
+			Key:             queryResponse.Key,
+			Time:            e.Time,
+			DeviceID:        e.DeviceID,
+			DisplayName:     e.DisplayName,
+			Action:          e.Value,
+			Method:          lockMethod(e),
+			Source:          e.Source,
+			IsPhysical:      e.IsPhysical == "true",
+			IsDigital:       e.IsDigital == "true",
+			DescriptionText: e.DescriptionText,
+			RecordHash:      hex.EncodeToString(hash[:]),
+		}
+		if e.InstalledSmartAppID != "" && e.InstalledSmartAppID != "null" {
+			entry.InstalledSmartAppID = e.InstalledSmartAppID
+		}
+		if strings.HasPrefix(e.Value, "unlocked") {
+			entry.ArrivalKey = nearestArrival(arrivals, e.Time, window)
+			if entry.ArrivalKey == "" {
+				entry.NoPresenceArrival = true
+				report.UnexplainedUnlocks++
+			}
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+
+	return successJSON(report)
+}
+
+// lockMethodWords lists, in the order they are checked, the words of a
+// lock event's description text that give away how it was triggered.
+var lockMethodWords = []struct {
+	method string
+	words  []string
+}{
+	{"keypad", []string{"keypad", "code", "pin"}},
+	{"auto", []string{"auto", "autolock", "autolocked"}},
+	{"manual", []string{"manual", "manually", "thumb", "thumbturn", "key"}},
+	{"app", []string{"app", "remote", "remotely", "command"}},
+}
+
+// lockMethod works out how a lock event was triggered from what the hub
+// reported. SmartThings does not send the method as a field, so the
+// description text is checked first and the physical/digital flags are
+// used as a fallback, which is all there is for callers who cannot read
+// the event's private details. Only whole words count, so "barcode" is
+// not a code and "automation" not an auto lock.
+func lockMethod(e event) string {
+	words := map[string]bool{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(e.DescriptionText), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		words[word] = true
+	}
+	for _, candidate := range lockMethodWords {
+		for _, word := range candidate.words {
+			if words[word] {
+				return candidate.method
+			}
+		}
+	}
+	switch {
+	case e.IsPhysical == "true":
+		return "manual"
+	case e.IsDigital == "true" || e.Source == "app":
+		return "app"
+	}
+	return "unknown"
+}
+
+// presenceArrival is a presence sensor reporting present.
+type presenceArrival struct {
+	key string
+	at  time.Time
+}
+
+// nearestArrival returns the key of the arrival closest to at, if any is
+// within window of it.
+func nearestArrival(arrivals []presenceArrival, at string, window time.Duration) string {
+	atTime, err := parseEventTime(at)
+	if err != nil {
+		return ""
+	}
+	key := ""
+	best := window + 1
+	for _, arrival := range arrivals {
+		gap := atTime.Sub(arrival.at)
+		if gap < 0 {
+			gap = -gap
+		}
+		if gap <= window && gap < best {
+			key, best = arrival.key, gap
+		}
+	}
+	return key
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockMethod(t *testing.T) {
+	tests := []struct {
+		name string
+		e    event
+		want string
+	}{
+		{"code", event{DescriptionText: "Front Door was unlocked with code 2"}, "keypad"},
+		{"keypad", event{DescriptionText: "Locked from the keypad"}, "keypad"},
+		{"auto lock", event{DescriptionText: "Front Door was auto-locked"}, "auto"},
+		{"autolock", event{DescriptionText: "Autolock engaged"}, "auto"},
+		{"thumb turn", event{DescriptionText: "Front Door was locked by thumb turn"}, "manual"},
+		{"app", event{DescriptionText: "Front Door was unlocked from the App"}, "app"},
+		{"barcode is not a code", event{DescriptionText: "barcode scanner reported unlocked", IsDigital: "true"}, "app"},
+		{"encoded is not a code", event{DescriptionText: "encoded unlock", IsPhysical: "true"}, "manual"},
+		{"automation is not auto", event{DescriptionText: "unlocked by automation", IsDigital: "true"}, "app"},
+		{"physical flag", event{DescriptionText: "Front Door is unlocked", IsPhysical: "true"}, "manual"},
+		{"app source", event{DescriptionText: "Front Door is locked", Source: "app"}, "app"},
+		{"nothing to go on", event{DescriptionText: "Front Door is locked"}, "unknown"},
+	}
+	for _, tt := range tests {
+		if got := lockMethod(tt.e); got != tt.want {
+			t.Errorf("%s: lockMethod = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNearestArrival(t *testing.T) {
+	arrivals := []presenceArrival{
+		{key: "a", at: time.Date(2018, 8, 15, 9, 50, 0, 0, time.UTC)},
+		{key: "b", at: time.Date(2018, 8, 15, 10, 3, 0, 0, time.UTC)},
+	}
+	tests := []struct {
+		at     string
+		window time.Duration
+		want   string
+	}{
+		{"2018-08-15t10:00:00.000z", 10 * time.Minute, "b"},
+		{"2018-08-15t09:52:00.000z", 10 * time.Minute, "a"},
+		{"2018-08-15t10:20:00.000z", 10 * time.Minute, ""},
+		{"2018-08-15t10:00:00.000z", 2 * time.Minute, ""},
+	}
+	for _, tt := range tests {
+		if got := nearestArrival(arrivals, tt.at, tt.window); got != tt.want {
+			t.Errorf("nearestArrival(%s, %s) = %q, want %q", tt.at, tt.window, got, tt.want)
+		}
+	}
+}
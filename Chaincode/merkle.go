@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// Leaves and inner nodes of the day trees are hashed with different
+// prefixes so a leaf can never be passed off as an inner node. The
+// verifier package in Verifier/ must hash the same way.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// daySeal is the Merkle root over the events a location logged on one UTC
+// day, stored once under the seal composite key of locationId and date.
+// Keys lists the sealed events in tree order.
+type daySeal struct {
+	DocType    string   `json:"docType"`
+	LocationID string   `json:"locationId"`
+	Date       string   `json:"date"`
+	Root       string   `json:"root"`
+	Leaves     int      `json:"leaves"`
+	SealedAt   string   `json:"sealedAt"`
+	TxID       string   `json:"txId"`
+	Keys       []string `json:"keys"`
+}
+
+// proofStep is one sibling on the path from a leaf to the root. Left is
+// set when the sibling is the left child.
+type proofStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// inclusionProof is the response of getInclusionProof. Record is the event
+// in the canonical JSON its leaf was hashed from.
+type inclusionProof struct {
+	LocationID string      `json:"locationId"`
+	Date       string      `json:"date"`
+	EventKey   string      `json:"eventKey"`
+	Record     string      `json:"record"`
+	Leaf       string      `json:"leaf"`
+	Index      int         `json:"index"`
+	Leaves     int         `json:"leaves"`
+	Siblings   []proofStep `json:"siblings"`
+	Root       string      `json:"root"`
+	SealTxID   string      `json:"sealTxId"`
+}
+
+// merkleLeaf hashes a canonical event record.
+func merkleLeaf(record []byte) []byte {
+	sum := sha256.Sum256(append([]byte{merkleLeafPrefix}, record...))
+	return sum[:]
+}
+
+// merkleNode hashes two children.
+func merkleNode(left, right []byte) []byte {
+	buf := append([]byte{merkleNodePrefix}, left...)
+	sum := sha256.Sum256(append(buf, right...))
+	return sum[:]
+}
+
+// merkleTree returns the root over the leaves and the siblings on the path
+// of the leaf at index. A node without a sibling is carried up a level
+// unchanged.
+func merkleTree(leaves [][]byte, index int) ([]byte, []proofStep) {
+	if len(leaves) == 0 {
+		return nil, nil
+	}
+	steps := []proofStep{}
+	level := leaves
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			if index == i {
+				steps = append(steps, proofStep{Hash: hex.EncodeToString(level[i+1])})
+			} else if index == i+1 {
+				steps = append(steps, proofStep{Hash: hex.EncodeToString(level[i]), Left: true})
+			}
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+		index /= 2
+		level = next
+	}
+	return level[0], steps
+}
+
+// canonicalRecord reads an event and returns it in canonical JSON, the
+// same form event.hash uses.
+func canonicalRecord(stub shim.ChaincodeStubInterface, key string) (event, []byte, bool, error) {
+	var e event
+	found, err := getStateJSON(stub, key, &e)
+	if err != nil || !found {
+		return e, nil, found, err
+	}
+	return e, e.canonicalJSON(), true, nil
+}
+
+// parseSealDate reads a "2006-01-02" date argument.
+func parseSealDate(arg string) (time.Time, error) {
+	return time.Parse("2006-01-02", arg)
+}
+
+// sealDay computes the Merkle root over the events a location logged on a
+// UTC day, ordered by key, and stores it. A day can only be sealed once it
+// is over, and only once.
+// Args: locationId, date, e.g. "2018-08-15".
+func (t *SimpleAsset) sealDay(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and date")
+	}
+
+	locationId := args[0]
+	day, err := parseSealDate(args[1])
+	if err != nil {
+		return shim.Error("invalid date " + args[1] + ", expecting YYYY-MM-DD")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now.Before(day.AddDate(0, 0, 1)) {
+		return shim.Error("Day " + args[1] + " is not over yet")
+	}
+
+	date := day.Format("20060102")
+	sealKey, err := stub.CreateCompositeKey("seal", []string{locationId, date})
+	if err != nil {
+		return shim.Error("Failed to set composite key")
+	}
+	existing, err := stub.GetState(sealKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return shim.Error("Day " + args[1] + " is already sealed")
+	}
+
+	seal := daySeal{DocType: "DaySeal", LocationID: locationId, Date: date, SealedAt: now.Format(eventTimeLayout), TxID: stub.GetTxID(), Keys: []string{}}
+	records := map[string][]byte{}
+	from := day.Format(eventTimeLayout)
+	to := day.AddDate(0, 0, 1).Add(-time.Millisecond).Format(eventTimeLayout)
+	err = getEvents(stub, timelineQuery.rangeQueryString([]string{locationId}, from, to, nil, nil), func(key string, e event) bool {
+		records[key] = e.canonicalJSON()
+		seal.Keys = append(seal.Keys, key)
+		return true
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(seal.Keys) == 0 {
+		return shim.Error("No events to seal on " + args[1])
+	}
+	sort.Strings(seal.Keys)
+
+	leaves := make([][]byte, len(seal.Keys))
+	for i, key := range seal.Keys {
+		leaves[i] = merkleLeaf(records[key])
+	}
+	root, _ := merkleTree(leaves, 0)
+	seal.Root = hex.EncodeToString(root)
+	seal.Leaves = len(leaves)
+
+	if err := putStateJSON(stub, sealKey, seal); err != nil {
+		return shim.Error("Failed to set seal")
+	}
+	return successJSON(seal)
+}
+
+// getInclusionProof returns the Merkle path proving that an event is part
+// of its day's seal. The tree is rebuilt from the ledger, so a proof is
+// refused if any sealed event has changed since.
+// Args: locationId, eventKey.
+func (t *SimpleAsset) getInclusionProof(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and eventKey")
+	}
+
+	locationId := args[0]
+	// queryByDate hands out keys with "||" in place of the separators.
+	eventKey := strings.Replace(args[1], "||", "\u0000", -1)
+
+	e, _, found, err := canonicalRecord(stub, eventKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found || e.LocationID != locationId {
+		return shim.Error("Event not found for location " + locationId)
+	}
+
+	sealKey, err := stub.CreateCompositeKey("seal", []string{locationId, e.Date})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var seal daySeal
+	found, err = getStateJSON(stub, sealKey, &seal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("Day " + e.Date + " is not sealed")
+	}
+	index := sort.SearchStrings(seal.Keys, eventKey)
+	if index == len(seal.Keys) || seal.Keys[index] != eventKey {
+		return shim.Error("Event was logged after day " + e.Date + " was sealed")
+	}
+
+	proof := inclusionProof{LocationID: locationId, Date: seal.Date, EventKey: eventKey, Index: index, Leaves: seal.Leaves, Root: seal.Root, SealTxID: seal.TxID}
+	leaves := make([][]byte, len(seal.Keys))
+	for i, key := range seal.Keys {
+		sealed, record, found, err := canonicalRecord(stub, key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !found {
+			return shim.Error("Sealed event " + key + " is missing")
+		}
+		leaves[i] = merkleLeaf(record)
+		// Erased events keep the leaf they were sealed with.
+		if sealed.DocType == "Tombstone" {
+			tomb, err := getTombstone(stub, key)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if leaves[i], err = hex.DecodeString(tomb.LeafHash); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		if i == index {
+			proof.Record = string(record)
+			proof.Leaf = hex.EncodeToString(leaves[i])
+		}
+	}
+	root, siblings := merkleTree(leaves, index)
+	if hex.EncodeToString(root) != seal.Root {
+		return shim.Error("Events of day " + e.Date + " no longer match its seal")
+	}
+	proof.Siblings = siblings
+
+	return successJSON(proof)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func TestMerkleTree(t *testing.T) {
+	leaf := func(i int) []byte { return merkleLeaf([]byte(fmt.Sprintf(`{"n":%d}`, i))) }
+	a, b, c := leaf(0), leaf(1), leaf(2)
+	tests := []struct {
+		leaves [][]byte
+		root   []byte
+	}{
+		{[][]byte{a}, a},
+		{[][]byte{a, b}, merkleNode(a, b)},
+		{[][]byte{a, b, c}, merkleNode(merkleNode(a, b), c)},
+	}
+	for _, tt := range tests {
+		for i := range tt.leaves {
+			root, _ := merkleTree(tt.leaves, i)
+			if !bytes.Equal(root, tt.root) {
+				t.Errorf("merkleTree(%d leaves, %d) root = %x, want %x", len(tt.leaves), i, root, tt.root)
+			}
+		}
+	}
+	if root, steps := merkleTree(nil, 0); root != nil || steps != nil {
+		t.Errorf("merkleTree(nil) = %x, %v", root, steps)
+	}
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		var leaves [][]byte
+		for i := 0; i < n; i++ {
+			leaves = append(leaves, merkleLeaf([]byte(fmt.Sprintf(`{"n":%d}`, i))))
+		}
+		for i := range leaves {
+			root, steps := merkleTree(leaves, i)
+			hash := leaves[i]
+			for _, step := range steps {
+				sibling, _ := hex.DecodeString(step.Hash)
+				if step.Left {
+					hash = merkleNode(sibling, hash)
+				} else {
+					hash = merkleNode(hash, sibling)
+				}
+			}
+			if !bytes.Equal(hash, root) {
+				t.Errorf("proof of leaf %d of %d does not lead to the root", i, n)
+			}
+		}
+	}
+}
+
+func TestMerklePrefixes(t *testing.T) {
+	a, b := merkleLeaf([]byte("a")), merkleLeaf([]byte("b"))
+	inner := merkleNode(a, b)
+	if bytes.Equal(merkleLeaf(append(append([]byte{}, a...), b...)), inner) {
+		t.Error("a leaf hashes like an inner node")
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// occupancyKinds maps the capabilities that make up occupancy to the values
+// that start and end a session: presence sensors tell who is home and
+// motion sensors which rooms are active.
+var occupancyKinds = map[string]struct{ start, end string }{
+	"presence": {"present", "not present"},
+	"motion":   {"active", "inactive"},
+}
+
+// occupancyChange is a presence arrival or departure, or a motion sensor
+// going active or inactive, stored under the occupancy composite key of
+// locationId, kind, deviceId and time. Start is set for arrivals and
+// motion going active. queryOccupancy pairs the changes of a device into
+// sessions. Events that hide their value are recorded with Hidden set
+// instead of Start, whatever their value.
+type occupancyChange struct {
+	DocType    string `json:"docType"`
+	LocationID string `json:"locationId"`
+	Kind       string `json:"kind"`
+	DeviceID   string `json:"deviceId"`
+	Start      bool   `json:"start"`
+	Time       string `json:"time"`
+	EventKey   string `json:"eventKey"`
+	Hidden     bool   `json:"hidden,omitempty"`
+}
+
+// openSession is a session that had started but not ended when sessions
+// were still tracked as they happened, stored under the opensession
+// composite key of locationId, kind and deviceId. Only locations that
+// logged occupancy before changes were recorded have them.
+type openSession struct {
+	DocType     string `json:"docType"`
+	LocationID  string `json:"locationId"`
+	Kind        string `json:"kind"`
+	DeviceID    string `json:"deviceId"`
+	DisplayName string `json:"displayName"`
+	Start       string `json:"start"`
+	StartKey    string `json:"startKey"`
+}
+
+// occupancySession is a presence or motion session. Sessions that ended
+// before changes were recorded are stored under the session composite key
+// of locationId, start, kind and deviceId; newer ones are paired from
+// occupancy changes by queryOccupancy.
+type occupancySession struct {
+	DocType     string `json:"docType"`
+	LocationID  string `json:"locationId"`
+	Kind        string `json:"kind"`
+	DeviceID    string `json:"deviceId"`
+	DisplayName string `json:"displayName"`
+	Start       string `json:"start"`
+	End         string `json:"end"`
+	Seconds     int64  `json:"seconds"`
+	StartKey    string `json:"startKey"`
+	EndKey      string `json:"endKey"`
+}
+
+// occupancyInterval is a session clipped to the queried range. Ongoing is
+// set for sessions that had not ended by the end of the range.
+type occupancyInterval struct {
+	Start   string `json:"start"`
+	End     string `json:"end"`
+	Seconds int64  `json:"seconds"`
+	Ongoing bool   `json:"ongoing"`
+}
+
+// occupant is a person (presence sensor) or room (motion sensor) with its
+// sessions in the queried range.
+type occupant struct {
+	DeviceID    string              `json:"deviceId"`
+	DisplayName string              `json:"displayName"`
+	Sessions    []occupancyInterval `json:"sessions"`
+	Seconds     int64               `json:"seconds"`
+}
+
+// occupancyReport is the response of queryOccupancy. Occupied lists the
+// intervals when at least one person was home and PeakOccupants the most
+// people home at once.
+type occupancyReport struct {
+	LocationID      string              `json:"locationId"`
+	From            string              `json:"from"`
+	To              string              `json:"to"`
+	People          []*occupant         `json:"people"`
+	Rooms           []*occupant         `json:"rooms"`
+	Occupied        []occupancyInterval `json:"occupied"`
+	OccupiedSeconds int64               `json:"occupiedSeconds"`
+	PeakOccupants   int                 `json:"peakOccupants"`
+}
+
+// trackOccupancy is called by saveNewEvent for every stored event and
+// records presence arrivals and departures and motion going active or
+// inactive. Each change gets a key of its own and is written without
+// reading anything, so occupancy events of one device in the same block
+// do not conflict. When hidden is set the stored event hides its value, so
+// every event of an occupancy capability is recorded without telling
+// starts from ends.
+func trackOccupancy(stub shim.ChaincodeStubInterface, eventKey string, e event, hidden bool) error {
+	values, ok := occupancyKinds[e.Name]
+	if !ok || (!hidden && e.Value != values.start && e.Value != values.end) {
+		return nil
+	}
+
+	key, err := stub.CreateCompositeKey("occupancy", []string{e.LocationID, e.Name, e.DeviceID, e.Time})
+	if err != nil {
+		return err
+	}
+	change := occupancyChange{
+		DocType:    "OccupancyChange",
+		LocationID: e.LocationID,
+		Kind:       e.Name,
+		DeviceID:   e.DeviceID,
+		Start:      e.Value == values.start && !hidden,
+		Time:       e.Time,
+		EventKey:   eventKey,
+		Hidden:     hidden,
+	}
+	return putStateJSON(stub, key, change)
+}
+
+// pairChanges pairs the occupancy changes of one device, in time order,
+// into sessions: a start opens a session unless one is open, and an end
+// closes the open one. A session still open at the last change has no end.
+func pairChanges(changes []occupancyChange) []occupancySession {
+	var sessions []occupancySession
+	var open *occupancySession
+	for _, change := range changes {
+		if change.Start {
+			if open == nil {
+				open = &occupancySession{Kind: change.Kind, DeviceID: change.DeviceID, Start: change.Time, StartKey: change.EventKey}
+			}
+			continue
+		}
+		if open == nil || change.Time < open.Start {
+			continue
+		}
+		open.End = change.Time
+		open.EndKey = change.EventKey
+		start, errStart := parseEventTime(open.Start)
+		end, errEnd := parseEventTime(open.End)
+		if errStart == nil && errEnd == nil {
+			open.Seconds = int64(end.Sub(start) / time.Second)
+		}
+		sessions = append(sessions, *open)
+		open = nil
+	}
+	if open != nil {
+		sessions = append(sessions, *open)
+	}
+	return sessions
+}
+
+// deviceSessions returns the sessions of one kind of a device that may
+// overlap from and to: those starting in the range and the one that was
+// open at from, if any. A session opened before changes were recorded
+// counts as a start. Changes that hide their value are read from their
+// event and left out when the caller may not read it.
+func deviceSessions(stub shim.ChaincodeStubInterface, details *detailsReader, locationId, kind, deviceID, from, to string, legacy *openSession) ([]occupancySession, error) {
+	values := []string{locationId, kind, deviceID}
+	var changes []occupancyChange
+	if legacy != nil {
+		changes = append(changes, occupancyChange{Kind: kind, DeviceID: deviceID, Start: true, Time: legacy.Start, EventKey: legacy.StartKey})
+	}
+	seen := map[string]bool{}
+	for _, queryString := range []string{occupancyQuery.lastQueryString(values, from), occupancyQuery.rangeQueryString(values, from, to, nil, nil)} {
+		resultsIterator, err := stub.GetQueryResult(queryString)
+		if err != nil {
+			return nil, err
+		}
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return nil, err
+			}
+			if seen[queryResponse.Key] {
+				continue
+			}
+			seen[queryResponse.Key] = true
+			var change occupancyChange
+			if err := json.Unmarshal(queryResponse.Value, &change); err != nil {
+				resultsIterator.Close()
+				return nil, err
+			}
+			if change.Hidden {
+				e, ok, err := details.event(change.EventKey)
+				if err != nil {
+					resultsIterator.Close()
+					return nil, err
+				}
+				values := occupancyKinds[kind]
+				if !ok || (e.Value != values.start && e.Value != values.end) {
+					continue
+				}
+				change.Start = e.Value == values.start
+			}
+			changes = append(changes, change)
+		}
+		resultsIterator.Close()
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Time < changes[j].Time })
+	return pairChanges(changes), nil
+}
+
+// queryOccupancy returns who was home and which rooms were active between
+// two times, as sessions clipped to the range with total durations.
+// Args: locationId, from, to.
+func (t *SimpleAsset) queryOccupancy(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId, from and to")
+	}
+
+	locationId := args[0]
+	from, err := normalizeTime(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := normalizeTime(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rangeStart, _ := parseEventTime(from)
+	rangeEnd, _ := parseEventTime(to)
+	// Ongoing sessions run until the range ends, but not into the future.
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ongoingEnd := rangeEnd
+	if now.Before(ongoingEnd) {
+		ongoingEnd = now
+	}
+
+	var sessions []occupancySession
+	resultsIterator, err := stub.GetQueryResult(sessionQuery.rangeQueryString([]string{locationId}, from, "", nil, nil))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var session occupancySession
+		if err := json.Unmarshal(queryResponse.Value, &session); err != nil {
+			return shim.Error(err.Error())
+		}
+		if session.Start <= to {
+			sessions = append(sessions, session)
+		}
+	}
+
+	legacy := map[string]*openSession{}
+	openIterator, err := stub.GetStateByPartialCompositeKey("opensession", []string{locationId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer openIterator.Close()
+	for openIterator.HasNext() {
+		queryResponse, err := openIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var open openSession
+		if err := json.Unmarshal(queryResponse.Value, &open); err != nil {
+			return shim.Error(err.Error())
+		}
+		legacy[open.Kind+"/"+open.DeviceID] = &open
+	}
+
+	devices, err := getLocationDevices(stub, locationId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	kinds := make([]string, 0, len(occupancyKinds))
+	for kind := range occupancyKinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	details := newDetailsReader(stub)
+	for _, device := range devices {
+		record, _, err := getDeviceRecord(stub, device.DeviceID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, kind := range kinds {
+			open := legacy[kind+"/"+device.DeviceID]
+			if record.Capabilities[kind] == "" && open == nil {
+				continue
+			}
+			found, err := deviceSessions(stub, details, locationId, kind, device.DeviceID, from, to, open)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			for _, session := range found {
+				session.DisplayName = device.Latest.DisplayName
+				sessions = append(sessions, session)
+			}
+		}
+	}
+
+	report := occupancyReport{LocationID: locationId, From: from, To: to, People: []*occupant{}, Rooms: []*occupant{}, Occupied: []occupancyInterval{}}
+	occupants := map[string]*occupant{}
+	var people []occupancyInterval
+	for _, session := range sessions {
+		interval, ok := session.clip(rangeStart, rangeEnd, ongoingEnd)
+		if !ok {
+			continue
+		}
+
+		o, ok := occupants[session.Kind+"/"+session.DeviceID]
+		if !ok {
+			o = &occupant{DeviceID: session.DeviceID, DisplayName: session.DisplayName}
+			occupants[session.Kind+"/"+session.DeviceID] = o
+			if session.Kind == "presence" {
+				report.People = append(report.People, o)
+			} else {
+				report.Rooms = append(report.Rooms, o)
+			}
+		}
+		o.Sessions = append(o.Sessions, interval)
+		o.Seconds += interval.Seconds
+		if session.Kind == "presence" {
+			people = append(people, interval)
+		}
+	}
+	for _, list := range [][]*occupant{report.People, report.Rooms} {
+		for _, o := range list {
+			sort.Slice(o.Sessions, func(i, j int) bool { return o.Sessions[i].Start < o.Sessions[j].Start })
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].DeviceID < list[j].DeviceID })
+	}
+
+	report.Occupied, report.PeakOccupants = mergeIntervals(people)
+	for _, interval := range report.Occupied {
+		report.OccupiedSeconds += interval.Seconds
+	}
+
+	return successJSON(report)
+}
+
+// clip returns the part of the session between rangeStart and rangeEnd.
+// Sessions that have not ended run until ongoingEnd. ok is false when the
+// session lies outside the range.
+func (session occupancySession) clip(rangeStart, rangeEnd, ongoingEnd time.Time) (occupancyInterval, bool) {
+	start, err := parseEventTime(session.Start)
+	if err != nil {
+		return occupancyInterval{}, false
+	}
+	end := ongoingEnd
+	ongoing := session.End == ""
+	if !ongoing {
+		if end, err = parseEventTime(session.End); err != nil {
+			return occupancyInterval{}, false
+		}
+		if end.After(rangeEnd) {
+			end = rangeEnd
+			ongoing = true
+		}
+	}
+	if start.Before(rangeStart) {
+		start = rangeStart
+	}
+	if end.Before(start) {
+		return occupancyInterval{}, false
+	}
+	return occupancyInterval{
+		Start:   start.Format(eventTimeLayout),
+		End:     end.Format(eventTimeLayout),
+		Seconds: int64(end.Sub(start) / time.Second),
+		Ongoing: ongoing,
+	}, true
+}
+
+// mergeIntervals merges overlapping intervals and returns the merged
+// intervals with the largest number of intervals overlapping at once.
+func mergeIntervals(intervals []occupancyInterval) ([]occupancyInterval, int) {
+	type edge struct {
+		at    string
+		delta int
+	}
+	var edges []edge
+	for _, interval := range intervals {
+		edges = append(edges, edge{interval.Start, 1}, edge{interval.End, -1})
+	}
+	// Ends sort before starts at the same time, so back to back sessions
+	// do not count as overlapping.
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].at != edges[j].at {
+			return edges[i].at < edges[j].at
+		}
+		return edges[i].delta < edges[j].delta
+	})
+
+	merged := []occupancyInterval{}
+	count, peak := 0, 0
+	var start string
+	for _, e := range edges {
+		if count == 0 && e.delta > 0 {
+			start = e.at
+		}
+		count += e.delta
+		if count > peak {
+			peak = count
+		}
+		if count == 0 && e.delta < 0 && e.at > start {
+			from, _ := parseEventTime(start)
+			to, _ := parseEventTime(e.at)
+			merged = append(merged, occupancyInterval{Start: start, End: e.at, Seconds: int64(to.Sub(from) / time.Second)})
+		}
+	}
+	return merged, peak
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessionClip(t *testing.T) {
+	rangeStart := time.Date(2018, 8, 15, 0, 0, 0, 0, time.UTC)
+	rangeEnd := time.Date(2018, 8, 16, 0, 0, 0, 0, time.UTC)
+	now := time.Date(2018, 8, 15, 20, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		session occupancySession
+		want    occupancyInterval
+		ok      bool
+	}{
+		{
+			"inside",
+			occupancySession{Start: "2018-08-15t08:00:00.000z", End: "2018-08-15t09:30:00.000z"},
+			occupancyInterval{"2018-08-15t08:00:00.000z", "2018-08-15t09:30:00.000z", 5400, false}, true,
+		},
+		{
+			"started before the range",
+			occupancySession{Start: "2018-08-14t23:00:00.000z", End: "2018-08-15t01:00:00.000z"},
+			occupancyInterval{"2018-08-15t00:00:00.000z", "2018-08-15t01:00:00.000z", 3600, false}, true,
+		},
+		{
+			"ended after the range",
+			occupancySession{Start: "2018-08-15t23:00:00.000z", End: "2018-08-16t02:00:00.000z"},
+			occupancyInterval{"2018-08-15t23:00:00.000z", "2018-08-16t00:00:00.000z", 3600, true}, true,
+		},
+		{
+			"ongoing",
+			occupancySession{Start: "2018-08-15t19:00:00.000z"},
+			occupancyInterval{"2018-08-15t19:00:00.000z", "2018-08-15t20:00:00.000z", 3600, true}, true,
+		},
+		{
+			"ended before the range",
+			occupancySession{Start: "2018-08-14t10:00:00.000z", End: "2018-08-14t11:00:00.000z"},
+			occupancyInterval{}, false,
+		},
+	}
+	for _, tt := range tests {
+		got, ok := tt.session.clip(rangeStart, rangeEnd, now)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("%s: clip = %+v, %v", tt.name, got, ok)
+		}
+	}
+}
+
+func TestMergeIntervals(t *testing.T) {
+	interval := func(start, end string) occupancyInterval {
+		return occupancyInterval{Start: "2018-08-15t" + start + ":00.000z", End: "2018-08-15t" + end + ":00.000z"}
+	}
+	tests := []struct {
+		name      string
+		intervals []occupancyInterval
+		want      []occupancyInterval
+		peak      int
+	}{
+		{"none", nil, []occupancyInterval{}, 0},
+		{
+			"overlapping",
+			[]occupancyInterval{interval("08:00", "10:00"), interval("09:00", "11:00"), interval("09:30", "09:45")},
+			[]occupancyInterval{{Start: "2018-08-15t08:00:00.000z", End: "2018-08-15t11:00:00.000z", Seconds: 10800}},
+			3,
+		},
+		{
+			"apart",
+			[]occupancyInterval{interval("12:00", "13:00"), interval("08:00", "09:00")},
+			[]occupancyInterval{
+				{Start: "2018-08-15t08:00:00.000z", End: "2018-08-15t09:00:00.000z", Seconds: 3600},
+				{Start: "2018-08-15t12:00:00.000z", End: "2018-08-15t13:00:00.000z", Seconds: 3600},
+			},
+			1,
+		},
+		{
+			"back to back",
+			[]occupancyInterval{interval("08:00", "09:00"), interval("09:00", "10:00")},
+			[]occupancyInterval{
+				{Start: "2018-08-15t08:00:00.000z", End: "2018-08-15t09:00:00.000z", Seconds: 3600},
+				{Start: "2018-08-15t09:00:00.000z", End: "2018-08-15t10:00:00.000z", Seconds: 3600},
+			},
+			1,
+		},
+	}
+	for _, tt := range tests {
+		got, peak := mergeIntervals(tt.intervals)
+		if !reflect.DeepEqual(got, tt.want) || peak != tt.peak {
+			t.Errorf("%s: mergeIntervals = %+v, %d", tt.name, got, peak)
+		}
+	}
+}
+
+func TestPairChanges(t *testing.T) {
+	change := func(start bool, at string) occupancyChange {
+		return occupancyChange{Kind: "presence", DeviceID: "phone", Start: start, Time: at, EventKey: at}
+	}
+	changes := []occupancyChange{
+		change(false, "2018-08-15t07:00:00.000z"),
+		change(true, "2018-08-15t08:00:00.000z"),
+		change(true, "2018-08-15t08:30:00.000z"),
+		change(false, "2018-08-15t09:00:00.000z"),
+		change(false, "2018-08-15t09:10:00.000z"),
+		change(true, "2018-08-15t18:00:00.000z"),
+	}
+	want := []occupancySession{
+		{Kind: "presence", DeviceID: "phone", Start: "2018-08-15t08:00:00.000z", End: "2018-08-15t09:00:00.000z", Seconds: 3600, StartKey: "2018-08-15t08:00:00.000z", EndKey: "2018-08-15t09:00:00.000z"},
+		{Kind: "presence", DeviceID: "phone", Start: "2018-08-15t18:00:00.000z", StartKey: "2018-08-15t18:00:00.000z"},
+	}
+	if got := pairChanges(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("pairChanges() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// pageBookmark marks where a time ordered page ended: the time of the last
+// record returned and how many records with that time were returned so far.
+// Counting records instead of remembering keys keeps paging correct when
+// several devices report at the same instant.
+type pageBookmark struct {
+	Time string `json:"time"`
+	Seen int    `json:"seen"`
+}
+
+// encode returns the opaque bookmark string handed to the caller.
+func (b pageBookmark) encode() string {
+	bookmarkJSON, _ := json.Marshal(b)
+	return base64.RawURLEncoding.EncodeToString(bookmarkJSON)
+}
+
+// decodeBookmark parses a bookmark returned by a previous page. An empty
+// string starts from the first page.
+func decodeBookmark(bookmark string) (pageBookmark, error) {
+	var b pageBookmark
+	if bookmark == "" {
+		return b, nil
+	}
+	bookmarkJSON, err := base64.RawURLEncoding.DecodeString(bookmark)
+	if err != nil {
+		return b, fmt.Errorf("invalid bookmark")
+	}
+	if err := json.Unmarshal(bookmarkJSON, &b); err != nil {
+		return b, fmt.Errorf("invalid bookmark")
+	}
+	return b, nil
+}
+
+// parsePageSize reads an optional page size argument.
+func parsePageSize(arg string) (int, error) {
+	if arg == "" {
+		return defaultPageSize, nil
+	}
+	pageSize, err := strconv.Atoi(arg)
+	if err != nil || pageSize < 1 || pageSize > maxPageSize {
+		return 0, fmt.Errorf("page size must be a number between 1 and %d", maxPageSize)
+	}
+	return pageSize, nil
+}
+
+// getQueryResultPage runs a rich query whose results are sorted on the time
+// field and returns at most pageSize of them, skipping the records the
+// bookmark says were already returned. The query has to start at or before
+// the bookmark's time. The response carries the bookmark of the next page,
+// which is empty once all records have been returned. Events come back
+// with the private details the caller may read, and those the query's
+// filters let through for hiding the filtered field are only returned when
+// they match once merged. The bookmark counts the ones left out too.
+func getQueryResultPage(stub shim.ChaincodeStubInterface, queryString string, filters []queryFilter, pageSize int, after pageBookmark) ([]byte, error) {
+
+	fmt.Printf("- getQueryResultPage queryString:\n%s\n", queryString)
+
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString(`{"Records":[`)
+
+	details := newDetailsReader(stub)
+	next := after
+	count := 0
+	more := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var record struct {
+			Time string `json:"time"`
+		}
+		if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+			return nil, err
+		}
+		if record.Time < after.Time {
+			continue
+		}
+		if record.Time == after.Time && after.Seen > 0 {
+			after.Seen--
+			continue
+		}
+		if count == pageSize {
+			more = true
+			break
+		}
+
+		if record.Time == next.Time {
+			next.Seen++
+		} else {
+			next = pageBookmark{Time: record.Time, Seen: 1}
+		}
+		value, err := details.mergeRecord(queryResponse.Key, queryResponse.Value)
+		if err != nil {
+			return nil, err
+		}
+		var merged event
+		if err := json.Unmarshal(value, &merged); err != nil {
+			return nil, err
+		}
+		if !matchesAll(filters, &merged) {
+			continue
+		}
+
+		if count > 0 {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString(`{"Key":`)
+		buffer.WriteString(jsonString(queryResponse.Key))
+		buffer.WriteString(`,"Record":`)
+		buffer.Write(value)
+		buffer.WriteString("}")
+		count++
+	}
+
+	buffer.WriteString(`],"ResponseMetadata":{"RecordsCount":`)
+	buffer.WriteString(strconv.Itoa(count))
+	buffer.WriteString(`,"Bookmark":`)
+	if more {
+		buffer.WriteString(jsonString(next.encode()))
+	} else {
+		buffer.WriteString(`""`)
+	}
+	buffer.WriteString("}}")
+
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestBookmarkRoundTrip(t *testing.T) {
+	tests := []pageBookmark{
+		{},
+		{Time: "2018-08-01t01:00:00.000z", Seen: 1},
+		{Time: "2018-08-01t01:00:00.000z", Seen: 3},
+	}
+	for _, b := range tests {
+		got, err := decodeBookmark(b.encode())
+		if err != nil {
+			t.Fatalf("%+v: %s", b, err)
+		}
+		if got != b {
+			t.Errorf("decodeBookmark(encode(%+v)) = %+v", b, got)
+		}
+	}
+	if got, err := decodeBookmark(""); err != nil || got != (pageBookmark{}) {
+		t.Errorf(`decodeBookmark("") = %+v, %v`, got, err)
+	}
+	for _, bad := range []string{"not base64!", "bm90IGpzb24"} {
+		if _, err := decodeBookmark(bad); err == nil {
+			t.Errorf("decodeBookmark(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestParsePageSize(t *testing.T) {
+	tests := []struct {
+		arg     string
+		want    int
+		wantErr bool
+	}{
+		{"", defaultPageSize, false},
+		{"1", 1, false},
+		{"1000", maxPageSize, false},
+		{"0", 0, true},
+		{"1001", 0, true},
+		{"ten", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePageSize(tt.arg)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parsePageSize(%q) = %d, %v", tt.arg, got, err)
+		}
+	}
+}
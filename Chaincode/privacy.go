@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// eventDetails is the private part of an event: everything but the ids,
+// the capability and the times, since names, values, sources and free text
+// can identify the household and tell when it is home. It is stored with
+// PutPrivateData under the event's key in the collection of the
+// organisation that saved the event; the public Event keeps its hash. Salt
+// keeps the hash from being matched against guessed details. Details stored
+// before names, values and sources moved into them only hold the location
+// and the free text, and those before salting have no salt.
+type eventDetails struct {
+	DocType             string `json:"docType"`
+	Location            string `json:"location"`
+	Description         string `json:"description"`
+	DescriptionText     string `json:"descriptionText"`
+	DisplayName         string `json:"displayName,omitempty"`
+	Device              string `json:"device,omitempty"`
+	InstalledSmartAppID string `json:"installedSmartAppId,omitempty"`
+	IsDigital           string `json:"isDigital,omitempty"`
+	IsPhysical          string `json:"isPhysical,omitempty"`
+	Source              string `json:"source,omitempty"`
+	Unit                string `json:"unit,omitempty"`
+	Value               string `json:"value,omitempty"`
+	Salt                string `json:"salt,omitempty"`
+}
+
+// privateFields are the event fields splitEvent moves into the details.
+var privateFields = []string{"displayName", "device", "location", "description", "descriptionText", "installedSmartAppId", "isDigital", "isPhysical", "source", "unit", "value"}
+
+// detailsCollection returns the private data collection of an
+// organisation, as defined in collections_config.json.
+func detailsCollection(mspID string) string {
+	return "details" + mspID
+}
+
+// collectionSetting routes the private details of an organisation to a
+// collection other than its own, stored under the detailscollection
+// composite key of mspId.
+type collectionSetting struct {
+	DocType    string `json:"docType"`
+	MSPID      string `json:"mspId"`
+	Collection string `json:"collection"`
+}
+
+// callerCollection returns the private data collection of the organisation
+// submitting the transaction: the one set for it with setDetailsCollection,
+// else its own.
+func callerCollection(stub shim.ChaincodeStubInterface) (string, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", err
+	}
+	key, err := stub.CreateCompositeKey("detailscollection", []string{mspID})
+	if err != nil {
+		return "", err
+	}
+	var setting collectionSetting
+	found, err := getStateJSON(stub, key, &setting)
+	if err != nil || !found {
+		return detailsCollection(mspID), err
+	}
+	return setting.Collection, nil
+}
+
+// setDetailsCollection sets the collection the private details of an
+// organisation's events are stored in and read from, for organisations
+// without a collection of their own in collections_config.json. Only
+// administrators may call it. Events saved before keep their collection.
+// Args: mspId, collection.
+func (t *SimpleAsset) setDetailsCollection(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting mspId and collection")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	if args[0] == "" || args[1] == "" {
+		return shim.Error("mspId and collection must not be empty")
+	}
+
+	key, err := stub.CreateCompositeKey("detailscollection", []string{args[0]})
+	if err != nil {
+		return shim.Error("Failed to set composite key")
+	}
+	setting := collectionSetting{DocType: "DetailsCollection", MSPID: args[0], Collection: args[1]}
+	if err := putStateJSON(stub, key, setting); err != nil {
+		return shim.Error("Failed to set details collection")
+	}
+	return successJSON(setting)
+}
+
+// privacySetting says whether a location keeps the details of its events
+// in a private data collection, stored under the privacy composite key of
+// locationId. Locations without one keep their events whole in world
+// state, as before private details were introduced.
+type privacySetting struct {
+	DocType        string `json:"docType"`
+	LocationID     string `json:"locationId"`
+	PrivateDetails bool   `json:"privateDetails"`
+}
+
+// setPrivateDetails sets whether a location keeps the details of its
+// events in the collection of the organisation saving them. Only
+// administrators may call it, after making sure that collection exists
+// (see collections_config.json and setDetailsCollection). Events saved
+// before keep their form.
+// Args: locationId, "true" or "false".
+func (t *SimpleAsset) setPrivateDetails(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and privateDetails")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	private, err := strconv.ParseBool(args[1])
+	if err != nil {
+		return shim.Error("privateDetails must be true or false")
+	}
+	key, err := stub.CreateCompositeKey("privacy", []string{args[0]})
+	if err != nil {
+		return shim.Error("Failed to set composite key")
+	}
+	setting := privacySetting{DocType: "PrivacySetting", LocationID: args[0], PrivateDetails: private}
+	if err := putStateJSON(stub, key, setting); err != nil {
+		return shim.Error("Failed to set privacy setting")
+	}
+	return successJSON(setting)
+}
+
+// keepsDetailsPrivate reports whether a location keeps the details of its
+// events in a private data collection.
+func keepsDetailsPrivate(stub shim.ChaincodeStubInterface, locationId string) (bool, error) {
+	key, err := stub.CreateCompositeKey("privacy", []string{locationId})
+	if err != nil {
+		return false, err
+	}
+	var setting privacySetting
+	_, err = getStateJSON(stub, key, &setting)
+	return setting.PrivateDetails, err
+}
+
+// detailsSalt returns the salt of an event's private details. It is
+// derived from the signature of the transaction proposal, which every
+// endorser sees but which is not part of the transaction stored on the
+// ledger, so the salt is only known to the collection's members.
+func detailsSalt(stub shim.ChaincodeStubInterface, key string) (string, error) {
+	proposal, err := stub.GetSignedProposal()
+	if err != nil {
+		return "", err
+	}
+	if proposal == nil || len(proposal.Signature) == 0 {
+		return "", errors.New("transaction proposal is not signed")
+	}
+	sum := sha256.Sum256(append(append([]byte{}, proposal.Signature...), key...))
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// hash returns the details in canonical JSON and the SHA-256 of it.
+func (d eventDetails) hash() ([]byte, string, error) {
+	detailsJSONasBytes, err := json.Marshal(d)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(detailsJSONasBytes)
+	return detailsJSONasBytes, hex.EncodeToString(sum[:]), nil
+}
+
+// splitEvent separates the private details from an event. The public event
+// records the collection holding them and their salted hash, and loses the
+// numeric forms of its value too.
+func splitEvent(e event, collection, salt string) (event, []byte, error) {
+	details := eventDetails{
+		DocType:             "EventDetails",
+		Location:            e.Location,
+		Description:         e.Description,
+		DescriptionText:     e.DescriptionText,
+		DisplayName:         e.DisplayName,
+		Device:              e.Device,
+		InstalledSmartAppID: e.InstalledSmartAppID,
+		IsDigital:           e.IsDigital,
+		IsPhysical:          e.IsPhysical,
+		Source:              e.Source,
+		Unit:                e.Unit,
+		Value:               e.Value,
+		Salt:                salt,
+	}
+	detailsJSONasBytes, hash, err := details.hash()
+	if err != nil {
+		return e, nil, err
+	}
+	for _, name := range privateFields {
+		*e.field(name) = ""
+	}
+	e.NumericValue, e.NumericUnit, e.CanonicalValue, e.CanonicalUnit = nil, "", nil, ""
+	e.DetailsCollection = collection
+	e.DetailsHash = hash
+	return e, detailsJSONasBytes, nil
+}
+
+// detailsReader merges private details back into events read from world
+// state and decrypts encrypted fields. Only callers from the organisation
+// whose collection holds the details see them, and only callers passing
+// the key an event was encrypted with in the transient map see its
+// encrypted fields; for everyone else those fields stay as stored.
+type detailsReader struct {
+	stub       shim.ChaincodeStubInterface
+	collection string
+	keys       map[string][]byte
+	resolved   bool
+}
+
+// newDetailsReader returns a detailsReader for the transaction submitter.
+func newDetailsReader(stub shim.ChaincodeStubInterface) *detailsReader {
+	return &detailsReader{stub: stub}
+}
+
+// resolve looks up the caller's collection and keys once per query.
+func (r *detailsReader) resolve() error {
+	if r.resolved {
+		return nil
+	}
+	collection, err := callerCollection(r.stub)
+	if err != nil {
+		return err
+	}
+	keys, err := transientKeys(r.stub)
+	if err != nil {
+		return err
+	}
+	r.collection, r.keys, r.resolved = collection, keys, true
+	return nil
+}
+
+// decrypt decrypts the encrypted fields of the record stored under key, if
+// the caller passed its key, and reports whether all of them decrypted.
+// Fields that fail to decrypt are left as they are.
+func (r *detailsReader) decrypt(key, keyID string, names []string, field func(string) *string) (bool, error) {
+	if keyID == "" {
+		return true, nil
+	}
+	if err := r.resolve(); err != nil {
+		return false, err
+	}
+	encryptionKey, ok := r.keys[keyID]
+	if !ok {
+		return false, nil
+	}
+	all := true
+	for _, name := range names {
+		value := field(name)
+		if value == nil {
+			continue
+		}
+		plain, err := decryptField(encryptionKey, key, name, *value)
+		if err != nil {
+			all = false
+			continue
+		}
+		*value = plain
+	}
+	return all, nil
+}
+
+// merge decrypts the event stored under key and fills in its private
+// details, as far as the caller may read them. Details whose hash no
+// longer matches the public event are left out.
+func (r *detailsReader) merge(key string, e *event) error {
+	_, err := r.reveal(key, e)
+	return err
+}
+
+// reveal is merge, reporting whether the caller could read everything the
+// stored event hides.
+func (r *detailsReader) reveal(key string, e *event) (bool, error) {
+	decrypted, err := r.decrypt(key, e.EncryptionKeyID, e.EncryptedFields, e.field)
+	if err != nil {
+		return false, err
+	}
+	if e.DetailsCollection == "" {
+		if e.NumericValue == nil {
+			e.setNumericValue()
+		}
+		return decrypted, nil
+	}
+	if err := r.resolve(); err != nil {
+		return false, err
+	}
+	if e.DetailsCollection != r.collection {
+		return false, nil
+	}
+	detailsJSONasBytes, err := r.stub.GetPrivateData(r.collection, key)
+	if err != nil || detailsJSONasBytes == nil {
+		return false, err
+	}
+	var details eventDetails
+	if err := json.Unmarshal(detailsJSONasBytes, &details); err != nil {
+		return false, err
+	}
+	// The peer may hand back the details re-serialised, so the hash is
+	// checked over their canonical form.
+	_, hash, err := details.hash()
+	if err != nil {
+		return false, err
+	}
+	if hash != e.DetailsHash {
+		return false, nil
+	}
+	e.Location = details.Location
+	e.Description = details.Description
+	e.DescriptionText = details.DescriptionText
+	// Older details leave the rest in the public event.
+	for name, value := range map[string]string{
+		"displayName":         details.DisplayName,
+		"device":              details.Device,
+		"installedSmartAppId": details.InstalledSmartAppID,
+		"isDigital":           details.IsDigital,
+		"isPhysical":          details.IsPhysical,
+		"source":              details.Source,
+		"unit":                details.Unit,
+		"value":               details.Value,
+	} {
+		if value != "" {
+			*e.field(name) = value
+		}
+	}
+	if e.NumericValue == nil {
+		e.setNumericValue()
+	}
+	return decrypted, nil
+}
+
+// event loads the event stored under key, merged as far as the caller may
+// read it. Derived records that leave out what the event hides are filled
+// in from it; ok is false when the caller may not read it or it is gone.
+func (r *detailsReader) event(key string) (event, bool, error) {
+	var e event
+	found, err := getStateJSON(r.stub, key, &e)
+	if err != nil || !found {
+		return e, false, err
+	}
+	ok, err := r.reveal(key, &e)
+	return e, ok, err
+}
+
+// hides reports whether the stored form of an event keeps a field in
+// private details or encrypted. Details stored before names, values and
+// sources moved into them leave those in the event.
+func (e event) hides(name string) bool {
+	for _, encrypted := range e.EncryptedFields {
+		if encrypted == name {
+			return true
+		}
+	}
+	return e.DetailsCollection != "" && *e.field(name) == ""
+}
+
+// hidesDerived reports whether the stored form of an event hides fields
+// that saveNewEvent would copy into derived records: the latest state,
+// battery readings, incidents, automation events, occupancy changes, rule
+// hits and states and the location mode. Those then leave the fields out
+// and keep the event key, and readers fill them in with detailsReader.event.
+func (e event) hidesDerived() bool {
+	if e.DetailsCollection != "" {
+		return true
+	}
+	for _, field := range derivedFields {
+		if e.hides(field) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeRecord is merge for a raw record from a query result, which may be
+// a projection of a document. Derived records that left out what their
+// event hides are filled in from it. Other records without private details
+// or encrypted fields are returned unchanged.
+func (r *detailsReader) mergeRecord(key string, value []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(value, &doc); err != nil {
+		return value, nil
+	}
+	if hidden, _ := doc["hidden"].(bool); hidden {
+		eventKey, _ := doc["eventKey"].(string)
+		e, ok, err := r.event(eventKey)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return value, nil
+		}
+		for _, name := range privateFields {
+			if _, ok := doc[name]; ok {
+				doc[name] = *e.field(name)
+			}
+		}
+		delete(doc, "hidden")
+		return json.Marshal(doc)
+	}
+	keyID, _ := doc["encryptionKeyId"].(string)
+	collection, _ := doc["detailsCollection"].(string)
+	if keyID == "" && collection == "" {
+		return value, nil
+	}
+
+	var e event
+	if err := json.Unmarshal(value, &e); err != nil {
+		return value, nil
+	}
+	numeric := e.hides("value") || e.hides("unit")
+	if err := r.merge(key, &e); err != nil {
+		return nil, err
+	}
+	// Only the fields merge may have changed are written back, so the
+	// record keeps its shape, except for the numeric forms of a value
+	// that was hidden.
+	for _, name := range privateFields {
+		if _, ok := doc[name]; ok || (collection != "" && *e.field(name) != "") {
+			doc[name] = *e.field(name)
+		}
+	}
+	if numeric && e.NumericValue != nil {
+		doc["numericValue"], doc["numericUnit"] = *e.NumericValue, e.NumericUnit
+		if e.CanonicalValue != nil {
+			doc["canonicalValue"], doc["canonicalUnit"] = *e.CanonicalValue, e.CanonicalUnit
+		}
+	}
+	return json.Marshal(doc)
+}
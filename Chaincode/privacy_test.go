@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSplitEvent(t *testing.T) {
+	e := event{DocType: "Event", DisplayName: "front door", Location: "home", Description: "front door unlocked by alice", DescriptionText: "front door unlocked", InstalledSmartAppID: "app-1", DeviceID: "lock-1", Name: "lock", Value: "unlocked", Time: "2018-08-15t10:00:00.000z"}
+	tests := []struct {
+		name string
+		salt string
+	}{
+		{"salted", "0123456789abcdef0123456789abcdef"},
+		{"other salt", "fedcba9876543210fedcba9876543210"},
+		{"unsalted", ""},
+	}
+	hashes := map[string]bool{}
+	for _, tt := range tests {
+		public, private, err := splitEvent(e, "detailsOrg1MSP", tt.salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range privateFields {
+			if *public.field(name) != "" {
+				t.Errorf("%s: public event keeps %s", tt.name, name)
+			}
+		}
+		if public.DeviceID != e.DeviceID || public.Name != e.Name || public.Time != e.Time {
+			t.Errorf("%s: public event loses ids, capability or time: %+v", tt.name, public)
+		}
+		var details eventDetails
+		if err := json.Unmarshal(private, &details); err != nil {
+			t.Fatal(err)
+		}
+		if details.Salt != tt.salt || details.Description != e.Description || details.DisplayName != e.DisplayName || details.Value != e.Value || details.InstalledSmartAppID != e.InstalledSmartAppID {
+			t.Errorf("%s: details = %+v", tt.name, details)
+		}
+		if _, hash, _ := details.hash(); hash != public.DetailsHash {
+			t.Errorf("%s: details hash %s, event has %s", tt.name, hash, public.DetailsHash)
+		}
+		hashes[public.DetailsHash] = true
+	}
+	if len(hashes) != len(tests) {
+		t.Error("salts do not change the details hash")
+	}
+}
+
+func TestUnsaltedDetailsHash(t *testing.T) {
+	// Details stored before they were salted hash without a salt member.
+	details := eventDetails{DocType: "EventDetails", Location: "home"}
+	record, _, _ := details.hash()
+	if want := `{"docType":"EventDetails","location":"home","description":"","descriptionText":""}`; string(record) != want {
+		t.Errorf("hash() record = %s, want %s", record, want)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+//go:generate go run -tags indexgen . -dir META-INF/statedb/couchdb/indexes
+
+// queryShape describes a rich query the chaincode runs against CouchDB.
+// Every query string is built from a shape, so the shapes double as the
+// source for the index definitions shipped in META-INF (see indexgen.go).
+type queryShape struct {
+	name    string   // index name suffix, e.g. "Date" gives indexDate in indexDateDoc
+	docType string   // value matched against the docType field
+	fields  []string // selector fields matched for equality, in index order
+	ranged  string   // optional field bounded by a range and sorted on
+	numeric bool     // the ranged field holds numbers rather than strings
+}
+
+// Query shapes used by the chaincode. New rich queries must be added to
+// queryShapes so that an index is generated for them.
+var (
+	locationQuery   = queryShape{name: "Location", docType: "EventLess", fields: []string{"locationId"}}
+	dateQuery       = queryShape{name: "Date", docType: "Event", fields: []string{"locationId", "deviceId", "date"}}
+	capabilityQuery = queryShape{name: "Capability", docType: "Event", fields: []string{"locationId", "name"}, ranged: "time"}
+	timelineQuery   = queryShape{name: "Timeline", docType: "Event", fields: []string{"locationId"}, ranged: "time"}
+	sessionQuery    = queryShape{name: "Session", docType: "OccupancySession", fields: []string{"locationId"}, ranged: "end"}
+	occupancyQuery  = queryShape{name: "Occupancy", docType: "OccupancyChange", fields: []string{"locationId", "kind", "deviceId"}, ranged: "time"}
+	automationQuery = queryShape{name: "Automation", docType: "Event", fields: []string{"locationId", "installedSmartAppId"}, ranged: "time"}
+	summaryQuery    = queryShape{name: "Summary", docType: "HourlySummary", fields: []string{"locationId", "deviceId", "date"}, ranged: "hour"}
+	valueQuery      = queryShape{name: "Value", docType: "Event", fields: []string{"locationId", "name"}, ranged: "canonicalValue", numeric: true}
+	deviceQuery     = queryShape{name: "Device", docType: "Event", fields: []string{"locationId", "deviceId"}, ranged: "time"}
+	readingQuery    = queryShape{name: "Reading", docType: "Event", fields: []string{"locationId", "deviceId", "name"}, ranged: "time"}
+)
+
+var queryShapes = []queryShape{locationQuery, dateQuery, capabilityQuery, timelineQuery, sessionQuery, occupancyQuery, automationQuery, summaryQuery, valueQuery, deviceQuery, readingQuery}
+
+// queryFilter is an extra condition that is not part of the shape's index.
+// CouchDB applies it to the documents the index returns. The field has to
+// equal value, be one of in when it is set, or lie between from and to
+// inclusively when either is set. When hidden is set CouchDB also returns
+// the events that keep the field in private details or encrypted, and the
+// caller checks them with matches once it has merged them.
+type queryFilter struct {
+	field    string
+	value    string
+	in       []string
+	from, to string
+	hidden   bool
+}
+
+// matches reports whether a merged event passes the filter.
+func (f queryFilter) matches(e *event) bool {
+	field := e.field(f.field)
+	if field == nil {
+		return false
+	}
+	value := *field
+	if f.in != nil {
+		for _, in := range f.in {
+			if value == in {
+				return true
+			}
+		}
+		return false
+	}
+	if f.from == "" && f.to == "" {
+		return value == f.value
+	}
+	return (f.from == "" || value >= f.from) && (f.to == "" || value <= f.to)
+}
+
+// matchesAll reports whether a merged event passes the filters that let
+// hidden events through.
+func matchesAll(filters []queryFilter, e *event) bool {
+	for _, filter := range filters {
+		if filter.hidden && !filter.matches(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexName returns the name of the index generated for the shape.
+func (q queryShape) indexName() string {
+	return "index" + q.name
+}
+
+// indexDoc returns the design document holding the shape's index.
+func (q queryShape) indexDoc() string {
+	return q.indexName() + "Doc"
+}
+
+// indexFields lists the fields the shape's index is built on.
+func (q queryShape) indexFields() []string {
+	fields := append([]string{"docType"}, q.fields...)
+	if q.ranged != "" {
+		fields = append(fields, q.ranged)
+	}
+	return fields
+}
+
+// queryString renders the CouchDB query for the shape. values are matched
+// in order against the shape's fields and projection limits the returned
+// fields; an empty projection returns whole documents.
+func (q queryShape) queryString(values []string, projection []string) string {
+	return q.rangeQueryString(values, "", "", nil, projection)
+}
+
+// rangeQueryString renders the CouchDB query for a shape with a ranged
+// field. from and to bound the field inclusively, an empty bound is left
+// open, and results are sorted on the index so they come back in order.
+// Bounds of a numeric field are written as they are, so they must be
+// formatted numbers.
+func (q queryShape) rangeQueryString(values []string, from, to string, filters []queryFilter, projection []string) string {
+	return q.sortedQueryString(values, from, to, filters, projection, "asc", 0)
+}
+
+// lastQueryString renders the CouchDB query for the latest document of a
+// shape whose ranged field is at or before at.
+func (q queryShape) lastQueryString(values []string, at string) string {
+	return q.sortedQueryString(values, "", at, nil, nil, "desc", 1)
+}
+
+// firstQueryString renders the CouchDB query for the earliest document of
+// a shape whose ranged field is at or after at.
+func (q queryShape) firstQueryString(values []string, at string) string {
+	return q.sortedQueryString(values, at, "", nil, nil, "asc", 1)
+}
+
+// sortedQueryString is rangeQueryString with the sort direction of the
+// ranged field and an optional limit on the number of results.
+func (q queryShape) sortedQueryString(values []string, from, to string, filters []queryFilter, projection []string, direction string, limit int) string {
+	var buffer bytes.Buffer
+	buffer.WriteString(`{"selector":{"docType":`)
+	buffer.WriteString(jsonString(q.docType))
+	for i, field := range q.fields {
+		buffer.WriteString(",")
+		buffer.WriteString(jsonString(field))
+		buffer.WriteString(":")
+		buffer.WriteString(jsonString(values[i]))
+	}
+	if q.ranged != "" {
+		buffer.WriteString(",")
+		buffer.WriteString(jsonString(q.ranged))
+		switch {
+		case !q.numeric:
+			buffer.WriteString(`:{"$gte":`)
+			buffer.WriteString(jsonString(from))
+		case from != "":
+			buffer.WriteString(`:{"$gte":`)
+			buffer.WriteString(from)
+		default:
+			// The index only serves queries that bound the ranged field.
+			// null collates before every number.
+			buffer.WriteString(`:{"$gt":null`)
+		}
+		if to != "" {
+			buffer.WriteString(`,"$lte":`)
+			if q.numeric {
+				buffer.WriteString(to)
+			} else {
+				buffer.WriteString(jsonString(to))
+			}
+		}
+		buffer.WriteString("}")
+	}
+	var hidden []queryFilter
+	for _, filter := range filters {
+		if filter.hidden {
+			hidden = append(hidden, filter)
+			continue
+		}
+		buffer.WriteString(",")
+		writeFilter(&buffer, filter)
+	}
+	if len(hidden) > 0 {
+		// A selector can hold only one $or, so each goes into an $and.
+		buffer.WriteString(`,"$and":[`)
+		for i, filter := range hidden {
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			buffer.WriteString(`{"$or":[{`)
+			writeFilter(&buffer, filter)
+			buffer.WriteString(`},{"detailsCollection":{"$gt":""}},{"encryptedFields":{"$elemMatch":{"$eq":`)
+			buffer.WriteString(jsonString(filter.field))
+			buffer.WriteString(`}}}]}`)
+		}
+		buffer.WriteString("]")
+	}
+	buffer.WriteString("}")
+	if len(projection) > 0 {
+		buffer.WriteString(`,"fields":[`)
+		for i, field := range projection {
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			buffer.WriteString(jsonString(field))
+		}
+		buffer.WriteString("]")
+	}
+	if q.ranged != "" {
+		// CouchDB only sorts through an index when the sort lists the
+		// index fields in order, all in the same direction.
+		buffer.WriteString(`,"sort":[`)
+		for i, field := range q.indexFields() {
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			buffer.WriteString("{")
+			buffer.WriteString(jsonString(field))
+			buffer.WriteString(":")
+			buffer.WriteString(jsonString(direction))
+			buffer.WriteString("}")
+		}
+		buffer.WriteString("]")
+	}
+	if limit > 0 {
+		buffer.WriteString(`,"limit":`)
+		buffer.WriteString(strconv.Itoa(limit))
+	}
+	buffer.WriteString(`,"use_index":["_design/`)
+	buffer.WriteString(q.indexDoc())
+	buffer.WriteString(`","`)
+	buffer.WriteString(q.indexName())
+	buffer.WriteString(`"]}`)
+	return buffer.String()
+}
+
+// writeFilter writes the selector member of a filter.
+func writeFilter(buffer *bytes.Buffer, filter queryFilter) {
+	buffer.WriteString(jsonString(filter.field))
+	buffer.WriteString(":")
+	if filter.in != nil {
+		buffer.WriteString(`{"$in":[`)
+		for i, value := range filter.in {
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			buffer.WriteString(jsonString(value))
+		}
+		buffer.WriteString("]}")
+		return
+	}
+	if filter.from == "" && filter.to == "" {
+		buffer.WriteString(jsonString(filter.value))
+		return
+	}
+	buffer.WriteString("{")
+	if filter.from != "" {
+		buffer.WriteString(`"$gte":`)
+		buffer.WriteString(jsonString(filter.from))
+	}
+	if filter.to != "" {
+		if filter.from != "" {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString(`"$lte":`)
+		buffer.WriteString(jsonString(filter.to))
+	}
+	buffer.WriteString("}")
+}
+
+// jsonString quotes s as a JSON string so caller supplied values cannot
+// break out of the selector.
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
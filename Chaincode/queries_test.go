@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueryShapesHaveCoveringIndexes(t *testing.T) {
+	if err := checkIndexes(indexDir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckIndexesReportsMissingIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indexes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Every index but the first one.
+	for _, q := range queryShapes[1:] {
+		indexJSON, err := json.Marshal(indexFor(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, q.indexName()+".json"), indexJSON, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkIndexes(dir); err == nil {
+		t.Fatalf("expected %s to be reported missing", queryShapes[0].indexName())
+	}
+}
+
+func TestReadIndexesRejectsSeveralDefinitionsPerFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indexes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index := `{"index":{"fields":["docType"]},"ddoc":"indexOwnerDoc","name":"indexOwner","type":"json"}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "indexOwner.json"), []byte(index+index), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readIndexes(dir); err == nil {
+		t.Fatal("expected an error for two definitions in one file")
+	}
+}
+
+func TestCovers(t *testing.T) {
+	shape := queryShape{name: "Test", docType: "Event", fields: []string{"locationId", "name"}, ranged: "time"}
+	tests := []struct {
+		name   string
+		fields []string
+		want   bool
+	}{
+		{"exact", []string{"docType", "locationId", "name", "time"}, true},
+		{"other order", []string{"docType", "name", "locationId", "time"}, true},
+		{"missing ranged field", []string{"docType", "locationId", "name"}, false},
+		{"extra field", []string{"docType", "locationId", "name", "time", "deviceId"}, false},
+	}
+	for _, tt := range tests {
+		var index couchIndex
+		index.Index.Fields = tt.fields
+		if got := index.covers(shape); got != tt.want {
+			t.Errorf("%s: covers = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRangeQueryString(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			"equality",
+			dateQuery.queryString([]string{"loc", "dev", "20180801"}, []string{"value"}),
+			`{"selector":{"docType":"Event","locationId":"loc","deviceId":"dev","date":"20180801"},"fields":["value"],"use_index":["_design/indexDateDoc","indexDate"]}`,
+		},
+		{
+			"open range",
+			timelineQuery.rangeQueryString([]string{"loc"}, "a", "", nil, nil),
+			`{"selector":{"docType":"Event","locationId":"loc","time":{"$gte":"a"}},"sort":[{"docType":"asc"},{"locationId":"asc"},{"time":"asc"}],"use_index":["_design/indexTimelineDoc","indexTimeline"]}`,
+		},
+		{
+			"range and filter",
+			capabilityQuery.rangeQueryString([]string{"loc", "motion"}, "a", "b", []queryFilter{{field: "value", value: "active"}}, nil),
+			`{"selector":{"docType":"Event","locationId":"loc","name":"motion","time":{"$gte":"a","$lte":"b"},"value":"active"},"sort":[{"docType":"asc"},{"locationId":"asc"},{"name":"asc"},{"time":"asc"}],"use_index":["_design/indexCapabilityDoc","indexCapability"]}`,
+		},
+		{
+			"one of",
+			timelineQuery.rangeQueryString([]string{"loc"}, "a", "b", []queryFilter{{field: "installedSmartAppId", in: []string{"", "null"}}}, nil),
+			`{"selector":{"docType":"Event","locationId":"loc","time":{"$gte":"a","$lte":"b"},"installedSmartAppId":{"$in":["","null"]}},"sort":[{"docType":"asc"},{"locationId":"asc"},{"time":"asc"}],"use_index":["_design/indexTimelineDoc","indexTimeline"]}`,
+		},
+		{
+			"hidden filters",
+			timelineQuery.rangeQueryString([]string{"loc"}, "a", "b", []queryFilter{{field: "isPhysical", value: "true", hidden: true}, {field: "isStateChange", value: "true"}, {field: "installedSmartAppId", in: []string{"", "null"}, hidden: true}}, nil),
+			`{"selector":{"docType":"Event","locationId":"loc","time":{"$gte":"a","$lte":"b"},"isStateChange":"true","$and":[{"$or":[{"isPhysical":"true"},{"detailsCollection":{"$gt":""}},{"encryptedFields":{"$elemMatch":{"$eq":"isPhysical"}}}]},{"$or":[{"installedSmartAppId":{"$in":["","null"]}},{"detailsCollection":{"$gt":""}},{"encryptedFields":{"$elemMatch":{"$eq":"installedSmartAppId"}}}]}]},"sort":[{"docType":"asc"},{"locationId":"asc"},{"time":"asc"}],"use_index":["_design/indexTimelineDoc","indexTimeline"]}`,
+		},
+		{
+			"last",
+			readingQuery.lastQueryString([]string{"loc", "dev", "power"}, "b"),
+			`{"selector":{"docType":"Event","locationId":"loc","deviceId":"dev","name":"power","time":{"$gte":"","$lte":"b"}},"sort":[{"docType":"desc"},{"locationId":"desc"},{"deviceId":"desc"},{"name":"desc"},{"time":"desc"}],"limit":1,"use_index":["_design/indexReadingDoc","indexReading"]}`,
+		},
+		{
+			"values are escaped",
+			locationQuery.queryString([]string{`loc","docType":"x`}, nil),
+			`{"selector":{"docType":"EventLess","locationId":"loc\",\"docType\":\"x"},"use_index":["_design/indexLocationDoc","indexLocation"]}`,
+		},
+	}
+	for _, tt := range tests {
+		if tt.query != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, tt.query, tt.want)
+		}
+		if !json.Valid([]byte(tt.query)) {
+			t.Errorf("%s: invalid JSON %s", tt.name, tt.query)
+		}
+	}
+}
+
+func TestQueryFilterMatches(t *testing.T) {
+	e := event{Value: "active", IsPhysical: "true", InstalledSmartAppID: "null"}
+	tests := []struct {
+		filter queryFilter
+		want   bool
+	}{
+		{queryFilter{field: "value", value: "active"}, true},
+		{queryFilter{field: "value", value: "inactive"}, false},
+		{queryFilter{field: "installedSmartAppId", in: noSmartApp}, true},
+		{queryFilter{field: "installedSmartAppId", in: []string{"app-1"}}, false},
+		{queryFilter{field: "value", from: "a", to: "b"}, true},
+		{queryFilter{field: "value", from: "b"}, false},
+		{queryFilter{field: "isStateChange", value: "true"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.matches(&e); got != tt.want {
+			t.Errorf("%+v.matches() = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+	// Only filters that let hidden events through are checked again.
+	if !matchesAll([]queryFilter{{field: "value", value: "inactive"}}, &e) {
+		t.Error("matchesAll checks filters CouchDB applied")
+	}
+	if matchesAll([]queryFilter{{field: "value", value: "inactive", hidden: true}}, &e) {
+		t.Error("matchesAll passes a hidden event that does not match")
+	}
+}
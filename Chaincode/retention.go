@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// retentionPolicy is how long a location keeps its raw events, stored under
+// the retention composite key of locationId. Zero keeps them forever.
+// Aggregates such as device records, hourly summaries, battery readings,
+// occupancy changes, rule hits and day seals are kept regardless.
+type retentionPolicy struct {
+	DocType      string `json:"docType"`
+	LocationID   string `json:"locationId"`
+	RawEventDays int    `json:"rawEventDays"`
+}
+
+// minRetentionDays is the shortest retention owners may set. Only
+// administrators may shorten it further.
+const minRetentionDays = 30
+
+// pruneReport is the response of pruneExpired. Done is set once no expired
+// raw events are left.
+type pruneReport struct {
+	LocationID   string         `json:"locationId"`
+	RawEventDays int            `json:"rawEventDays"`
+	Cutoff       string         `json:"cutoff"`
+	Removed      int            `json:"removed"`
+	Capabilities map[string]int `json:"capabilities"`
+	Oldest       string         `json:"oldest,omitempty"`
+	Newest       string         `json:"newest,omitempty"`
+	Keys         []string       `json:"keys"`
+	Done         bool           `json:"done"`
+}
+
+// parseRetentionDays reads a rawEventDays argument.
+func parseRetentionDays(arg string) (int, error) {
+	days, err := strconv.Atoi(arg)
+	if err != nil || days < 0 {
+		return 0, errors.New("rawEventDays must be a whole number of days, 0 to keep raw events forever")
+	}
+	return days, nil
+}
+
+// retentionCutoff returns the cutoff of a retention of days at now and the
+// time of the newest event that has expired. The cutoff is exclusive: an
+// event exactly at it has not expired yet.
+func retentionCutoff(now time.Time, days int) (string, string) {
+	cutoff := now.AddDate(0, 0, -days)
+	return cutoff.Format(eventTimeLayout), cutoff.Add(-time.Millisecond).Format(eventTimeLayout)
+}
+
+// add records a pruned event. Events are pruned oldest first.
+func (r *pruneReport) add(key string, e event) {
+	if r.Oldest == "" {
+		r.Oldest = e.Time
+	}
+	r.Newest = e.Time
+	r.Capabilities[e.Name]++
+	r.Keys = append(r.Keys, key)
+	r.Removed++
+}
+
+// setRetention sets how many days a location keeps its raw events. Only
+// administrators and the location's owner may call it, and only
+// administrators may shorten it below minRetentionDays.
+// Args: locationId, rawEventDays, 0 to keep them forever.
+func (t *SimpleAsset) setRetention(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and rawEventDays")
+	}
+	admin, err := requireAdminOrOwner(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	days, err := parseRetentionDays(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !admin && days != 0 && days < minRetentionDays {
+		current, err := getRetentionPolicy(stub, args[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if current.RawEventDays == 0 || days < current.RawEventDays {
+			return shim.Error(fmt.Sprintf("only administrators may shorten retention below %d days", minRetentionDays))
+		}
+	}
+	key, err := stub.CreateCompositeKey("retention", []string{args[0]})
+	if err != nil {
+		return shim.Error("Failed to set composite key")
+	}
+	policy := retentionPolicy{DocType: "RetentionPolicy", LocationID: args[0], RawEventDays: days}
+	if err := putStateJSON(stub, key, policy); err != nil {
+		return shim.Error("Failed to set retention")
+	}
+	return successJSON(policy)
+}
+
+// getRetention returns the retention settings of a location.
+// Args: locationId.
+func (t *SimpleAsset) getRetention(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId")
+	}
+
+	policy, err := getRetentionPolicy(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return successJSON(policy)
+}
+
+// getRetentionPolicy loads the retention settings of a location, which keep
+// everything when none were set.
+func getRetentionPolicy(stub shim.ChaincodeStubInterface, locationId string) (retentionPolicy, error) {
+	policy := retentionPolicy{DocType: "RetentionPolicy", LocationID: locationId}
+	key, err := stub.CreateCompositeKey("retention", []string{locationId})
+	if err != nil {
+		return policy, err
+	}
+	_, err = getStateJSON(stub, key, &policy)
+	return policy, err
+}
+
+// pruneExpired removes up to batchSize of a location's raw events that are
+// older than its retention, oldest first, and reports what it removed.
+// Removed events leave a tombstone with their hashes, like erased ones, so
+// device hash chains and day seals stay verifiable; the tombstones are not
+// Event documents and drop out of the event indexes. Call again until the
+// report says done, e.g. from a daily job. Only administrators and the
+// location's owner may call it.
+// Args: locationId and optionally batchSize.
+func (t *SimpleAsset) pruneExpired(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and optionally batchSize")
+	}
+
+	locationId := args[0]
+	if _, err := requireAdminOrOwner(stub, locationId); err != nil {
+		return shim.Error(err.Error())
+	}
+	batchSize := defaultBatchSize
+	if len(args) == 2 {
+		var err error
+		if batchSize, err = parseBatchSize(args[1]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	policy, err := getRetentionPolicy(stub, locationId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	report := pruneReport{LocationID: locationId, RawEventDays: policy.RawEventDays, Capabilities: map[string]int{}, Keys: []string{}}
+	if policy.RawEventDays == 0 {
+		report.Done = true
+		return successJSON(report)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var to string
+	report.Cutoff, to = retentionCutoff(now, policy.RawEventDays)
+
+	resultsIterator, err := stub.GetQueryResult(timelineQuery.rangeQueryString([]string{locationId}, "", to, nil, nil))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for report.Removed < batchSize && resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var e event
+		if err := json.Unmarshal(queryResponse.Value, &e); err != nil {
+			return shim.Error(err.Error())
+		}
+		if _, err := tombstoneEvent(stub, queryResponse.Key, e, "expired", ""); err != nil {
+			return shim.Error("Failed to prune event: " + err.Error())
+		}
+		report.add(queryResponse.Key, e)
+	}
+	report.Done = !resultsIterator.HasNext()
+
+	return successJSON(report)
+}
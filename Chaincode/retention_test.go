@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionDays(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want int
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"90", 90, true},
+		{"-1", 0, false},
+		{"1.5", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseRetentionDays(tt.arg)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseRetentionDays(%q) = %d, %v", tt.arg, got, err)
+		}
+	}
+}
+
+func TestRetentionCutoff(t *testing.T) {
+	now := time.Date(2018, 8, 15, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		days   int
+		cutoff string
+		to     string
+	}{
+		{1, "2018-08-14t12:30:00.000z", "2018-08-14t12:29:59.999z"},
+		{90, "2018-05-17t12:30:00.000z", "2018-05-17t12:29:59.999z"},
+		{31, "2018-07-15t12:30:00.000z", "2018-07-15t12:29:59.999z"},
+	}
+	for _, tt := range tests {
+		cutoff, to := retentionCutoff(now, tt.days)
+		if cutoff != tt.cutoff || to != tt.to {
+			t.Errorf("retentionCutoff(%d) = %s, %s, want %s, %s", tt.days, cutoff, to, tt.cutoff, tt.to)
+		}
+	}
+}
+
+func TestPruneReportAdd(t *testing.T) {
+	report := pruneReport{Capabilities: map[string]int{}, Keys: []string{}}
+	events := []event{
+		{Name: "switch", Time: "2018-08-01t01:00:00.000z"},
+		{Name: "battery", Time: "2018-08-02t01:00:00.000z"},
+		{Name: "switch", Time: "2018-08-03t01:00:00.000z"},
+	}
+	for i, e := range events {
+		report.add(string(rune('a'+i)), e)
+	}
+	want := pruneReport{
+		Removed:      3,
+		Capabilities: map[string]int{"switch": 2, "battery": 1},
+		Oldest:       "2018-08-01t01:00:00.000z",
+		Newest:       "2018-08-03t01:00:00.000z",
+		Keys:         []string{"a", "b", "c"},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("add() = %+v, want %+v", report, want)
+	}
+}
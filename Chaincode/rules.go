@@ -0,0 +1,511 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// rule is an alert rule of a location. It matches events of one
+// capability, optionally of one device, whose value compares to Value with
+// Operator. Optional conditions limit it to a time of day window and to a
+// location mode. When For is set the value has to keep matching for that
+// long. Rules are only evaluated when events are saved, so such a rule is
+// checked whenever any event of the location arrives and its hit is
+// recorded with the first event after the duration has passed; a location
+// that goes quiet does not fire it.
+type rule struct {
+	DocType     string       `json:"docType"`
+	LocationID  string       `json:"locationId"`
+	RuleID      string       `json:"ruleId"`
+	Description string       `json:"description"`
+	Capability  string       `json:"capability"`
+	DeviceID    string       `json:"deviceId,omitempty"`
+	Operator    string       `json:"operator"`
+	Value       string       `json:"value"`
+	For         string       `json:"for,omitempty"`
+	Window      *dailyWindow `json:"window,omitempty"`
+	Mode        string       `json:"mode,omitempty"`
+
+	duration time.Duration
+}
+
+// locationRules holds the alert rules of a location, ordered by ruleId,
+// stored under the rules composite key of locationId. Keeping them in one
+// document lets every saved event load them with a single read, which
+// Fabric does not have to re-check for phantoms the way it re-runs range
+// scans at commit.
+type locationRules struct {
+	DocType    string `json:"docType"`
+	LocationID string `json:"locationId"`
+	Rules      []rule `json:"rules"`
+}
+
+// ruleStates tracks the devices matching the duration rules of a location,
+// by ruleId and deviceId, stored under the rulestates composite key of
+// locationId.
+type ruleStates struct {
+	DocType    string                          `json:"docType"`
+	LocationID string                          `json:"locationId"`
+	States     map[string]map[string]ruleState `json:"states"`
+}
+
+// ruleState tracks since when a device has matched a rule with a duration.
+// EventKey, DisplayName and Value come from the event that started the
+// match; Hidden is set instead of the name and value when it hides them.
+type ruleState struct {
+	Since       string `json:"since"`
+	EventKey    string `json:"eventKey"`
+	DisplayName string `json:"displayName"`
+	Value       string `json:"value"`
+	Fired       bool   `json:"fired"`
+	Hidden      bool   `json:"hidden,omitempty"`
+}
+
+// ruleHit records that an event triggered a rule. Since is set for rules
+// with a duration and is when the device started matching. Hidden is set
+// instead of the name and value when the event hides them.
+type ruleHit struct {
+	DocType     string `json:"docType"`
+	LocationID  string `json:"locationId"`
+	RuleID      string `json:"ruleId"`
+	Description string `json:"description"`
+	DeviceID    string `json:"deviceId"`
+	DisplayName string `json:"displayName"`
+	Capability  string `json:"capability"`
+	Value       string `json:"value"`
+	Time        string `json:"time"`
+	Since       string `json:"since,omitempty"`
+	EventKey    string `json:"eventKey"`
+	TxID        string `json:"txId"`
+	Hidden      bool   `json:"hidden,omitempty"`
+}
+
+// locationMode is the current mode of a location, kept from mode events.
+// When the mode event hides its value Mode is left empty, Hidden is set and
+// EventKey points to the event.
+type locationMode struct {
+	DocType    string `json:"docType"`
+	LocationID string `json:"locationId"`
+	Mode       string `json:"mode"`
+	Time       string `json:"time"`
+	Hidden     bool   `json:"hidden,omitempty"`
+	EventKey   string `json:"eventKey,omitempty"`
+}
+
+// validate checks the rule and resolves its duration and window.
+func (r *rule) validate() error {
+	if r.RuleID == "" || r.Capability == "" {
+		return fmt.Errorf("rule needs a ruleId and a capability")
+	}
+	switch r.Operator {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return fmt.Errorf("invalid operator %q", r.Operator)
+	}
+	if r.For != "" {
+		var err error
+		if r.duration, err = parseWindow(r.For); err != nil {
+			return err
+		}
+	}
+	if r.Window != nil {
+		if err := r.Window.resolve(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches reports whether an event value satisfies the rule's comparison.
+// Ordering operators compare numerically; equality compares numerically
+// when both sides are numbers and as text otherwise.
+func (r rule) matches(value string) bool {
+	got, errGot := strconv.ParseFloat(value, 64)
+	want, errWant := strconv.ParseFloat(r.Value, 64)
+	numeric := errGot == nil && errWant == nil
+	switch r.Operator {
+	case "==":
+		return (numeric && got == want) || value == r.Value
+	case "!=":
+		return !((numeric && got == want) || value == r.Value)
+	}
+	if !numeric {
+		return false
+	}
+	switch r.Operator {
+	case "<":
+		return got < want
+	case "<=":
+		return got <= want
+	case ">":
+		return got > want
+	}
+	return got >= want
+}
+
+// applies reports whether the rule's window and mode allow a hit at local
+// time t while the location is in mode.
+func (r rule) applies(t time.Time, mode string) bool {
+	if r.Window != nil && !r.Window.contains(t) {
+		return false
+	}
+	return r.Mode == "" || r.Mode == mode
+}
+
+// putRule stores an alert rule of a location.
+// Args: locationId, rule as JSON, e.g.
+// {"ruleId":"cold","capability":"temperature","operator":"<","value":"5"}
+// {"ruleId":"door","capability":"contact","operator":"==","value":"open","for":"30m","window":{"start":"22:00","end":"06:00"}}
+// {"ruleId":"intruder","capability":"motion","operator":"==","value":"active","mode":"away"}
+func (t *SimpleAsset) putRule(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and rule")
+	}
+
+	var r rule
+	if err := json.Unmarshal([]byte(args[1]), &r); err != nil {
+		return shim.Error("invalid rule: " + err.Error())
+	}
+	r.DocType = "Rule"
+	r.LocationID = args[0]
+	// Events are stored lowercased, so rules are too.
+	r.Capability = strings.ToLower(r.Capability)
+	r.DeviceID = strings.ToLower(r.DeviceID)
+	r.Value = strings.ToLower(r.Value)
+	r.Mode = strings.ToLower(r.Mode)
+	if err := r.validate(); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, rules, err := getLocationRules(stub, r.LocationID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	i := sort.Search(len(rules.Rules), func(i int) bool { return rules.Rules[i].RuleID >= r.RuleID })
+	if i == len(rules.Rules) || rules.Rules[i].RuleID != r.RuleID {
+		rules.Rules = append(rules.Rules, rule{})
+		copy(rules.Rules[i+1:], rules.Rules[i:])
+	}
+	rules.Rules[i] = r
+	if err := putStateJSON(stub, key, rules); err != nil {
+		return shim.Error("Failed to set rule")
+	}
+	return successJSON(r)
+}
+
+// deleteRule removes an alert rule and its tracked state. Recorded hits are
+// kept.
+// Args: locationId, ruleId.
+func (t *SimpleAsset) deleteRule(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and ruleId")
+	}
+
+	key, rules, err := getLocationRules(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	i := sort.Search(len(rules.Rules), func(i int) bool { return rules.Rules[i].RuleID >= args[1] })
+	if i == len(rules.Rules) || rules.Rules[i].RuleID != args[1] {
+		return shim.Error("rule not found")
+	}
+	rules.Rules = append(rules.Rules[:i], rules.Rules[i+1:]...)
+	if err := putStateJSON(stub, key, rules); err != nil {
+		return shim.Error("Failed to delete rule")
+	}
+
+	statesKey, states, err := getRuleStates(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if _, ok := states.States[args[1]]; ok {
+		delete(states.States, args[1])
+		if err := putStateJSON(stub, statesKey, states); err != nil {
+			return shim.Error("Failed to delete rule state")
+		}
+	}
+	return shim.Success(nil)
+}
+
+// listRules returns the alert rules of a location.
+// Args: locationId.
+func (t *SimpleAsset) listRules(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId")
+	}
+
+	_, rules, err := getLocationRules(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return successJSON(rules.Rules)
+}
+
+// queryRuleHits returns the rule hits of a location between two times.
+// Args: locationId, from, to.
+func (t *SimpleAsset) queryRuleHits(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId, from and to")
+	}
+
+	from, err := normalizeTime(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := normalizeTime(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("rulehit", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	details := newDetailsReader(stub)
+	hits := []ruleHit{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var hit ruleHit
+		if err := json.Unmarshal(queryResponse.Value, &hit); err != nil {
+			return shim.Error(err.Error())
+		}
+		if hit.Time < from || hit.Time > to {
+			continue
+		}
+		if hit.Hidden {
+			e, ok, err := details.event(hit.EventKey)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if ok {
+				hit.DisplayName, hit.Value, hit.Hidden = e.DisplayName, e.Value, false
+			}
+		}
+		hits = append(hits, hit)
+	}
+	return successJSON(hits)
+}
+
+// getLocationRules loads the alert rules of a location with the key they
+// are stored under, resolving their durations and windows.
+func getLocationRules(stub shim.ChaincodeStubInterface, locationId string) (string, locationRules, error) {
+	rules := locationRules{DocType: "Rules", LocationID: locationId, Rules: []rule{}}
+	key, err := stub.CreateCompositeKey("rules", []string{locationId})
+	if err != nil {
+		return "", rules, err
+	}
+	if _, err := getStateJSON(stub, key, &rules); err != nil {
+		return "", rules, err
+	}
+	for i := range rules.Rules {
+		if err := rules.Rules[i].validate(); err != nil {
+			return "", rules, err
+		}
+	}
+	return key, rules, nil
+}
+
+// getRuleStates loads the duration rule states of a location with the key
+// they are stored under.
+func getRuleStates(stub shim.ChaincodeStubInterface, locationId string) (string, ruleStates, error) {
+	states := ruleStates{DocType: "RuleStates", LocationID: locationId}
+	key, err := stub.CreateCompositeKey("rulestates", []string{locationId})
+	if err != nil {
+		return "", states, err
+	}
+	if _, err := getStateJSON(stub, key, &states); err != nil {
+		return "", states, err
+	}
+	if states.States == nil {
+		states.States = map[string]map[string]ruleState{}
+	}
+	return key, states, nil
+}
+
+// evaluateRules is called by saveNewEvent for every stored event. It keeps
+// the location mode up to date, checks the event against the location's
+// rules, stores a RuleHit for every rule triggered and emits them together
+// as a ruleHits chaincode event. The mode, rules and rule states are each
+// read from a single key, so two events of a location in the same block
+// only conflict when the first changes one of them. hidden is set when the
+// stored event hides what the hits, states and mode would copy.
+func evaluateRules(stub shim.ChaincodeStubInterface, eventKey string, e event, hidden bool) error {
+	modeKey, err := stub.CreateCompositeKey("mode", []string{e.LocationID})
+	if err != nil {
+		return err
+	}
+	var mode locationMode
+	if e.Name == "mode" {
+		mode = locationMode{DocType: "LocationMode", LocationID: e.LocationID, Mode: e.Value, Time: e.Time}
+		stored := mode
+		if hidden {
+			stored.Mode, stored.Hidden, stored.EventKey = "", true, eventKey
+		}
+		if err := putStateJSON(stub, modeKey, stored); err != nil {
+			return err
+		}
+	} else if _, err := getStateJSON(stub, modeKey, &mode); err != nil {
+		return err
+	} else if mode.Hidden {
+		// A submitter that may not read the mode event evaluates the rules
+		// as if no mode was known.
+		modeEvent, ok, err := newDetailsReader(stub).event(mode.EventKey)
+		if err != nil {
+			return err
+		}
+		if ok {
+			mode.Mode = modeEvent.Value
+		}
+	}
+
+	_, rules, err := getLocationRules(stub, e.LocationID)
+	if err != nil || len(rules.Rules) == 0 {
+		return err
+	}
+	loc, err := getLocationTimezone(stub, e.LocationID)
+	if err != nil {
+		return err
+	}
+	at, err := parseEventTime(e.Time)
+	if err != nil {
+		return nil
+	}
+	local := at.In(loc)
+
+	var hits []ruleHit
+	var statesKey string
+	var states ruleStates
+	statesChanged := false
+	for _, r := range rules.Rules {
+		hit := ruleHit{
+			DocType:     "RuleHit",
+			LocationID:  e.LocationID,
+			RuleID:      r.RuleID,
+			Description: r.Description,
+			DeviceID:    e.DeviceID,
+			DisplayName: e.DisplayName,
+			Capability:  e.Name,
+			Value:       e.Value,
+			Time:        e.Time,
+			EventKey:    eventKey,
+			TxID:        stub.GetTxID(),
+		}
+		if hidden {
+			hit.DisplayName, hit.Value, hit.Hidden = "", "", true
+		}
+		ours := r.Capability == e.Name && (r.DeviceID == "" || r.DeviceID == e.DeviceID)
+
+		if r.duration == 0 {
+			if ours && r.matches(e.Value) && r.applies(local, mode.Mode) {
+				hits = append(hits, hit)
+			}
+			continue
+		}
+
+		if statesKey == "" {
+			if statesKey, states, err = getRuleStates(stub, e.LocationID); err != nil {
+				return err
+			}
+		}
+		tracked := states.States[r.RuleID]
+		if tracked == nil {
+			tracked = map[string]ruleState{}
+			states.States[r.RuleID] = tracked
+		}
+		held := heldRuleStates(r, tracked, at, local, mode.Mode)
+		for _, deviceID := range held {
+			state := tracked[deviceID]
+			state.Fired = true
+			tracked[deviceID] = state
+			statesChanged = true
+
+			deviceHit := hit
+			if !ours || deviceID != e.DeviceID {
+				deviceHit.DeviceID = deviceID
+				deviceHit.DisplayName = state.DisplayName
+				deviceHit.Capability = r.Capability
+				deviceHit.Value = state.Value
+				deviceHit.EventKey = state.EventKey
+				deviceHit.Hidden = state.Hidden
+			}
+			deviceHit.Since = state.Since
+			hits = append(hits, deviceHit)
+		}
+
+		if !ours {
+			continue
+		}
+		_, isTracked := tracked[e.DeviceID]
+		switch {
+		case r.matches(e.Value) && !isTracked:
+			tracked[e.DeviceID] = ruleState{Since: e.Time, EventKey: eventKey, DisplayName: hit.DisplayName, Value: hit.Value, Hidden: hit.Hidden}
+			statesChanged = true
+		case !r.matches(e.Value) && isTracked:
+			delete(tracked, e.DeviceID)
+			statesChanged = true
+		}
+	}
+
+	if statesChanged {
+		for ruleID, tracked := range states.States {
+			if len(tracked) == 0 {
+				delete(states.States, ruleID)
+			}
+		}
+		if err := putStateJSON(stub, statesKey, states); err != nil {
+			return err
+		}
+	}
+	if len(hits) == 0 {
+		return nil
+	}
+	for _, hit := range hits {
+		key, err := stub.CreateCompositeKey("rulehit", []string{hit.LocationID, hit.Time, hit.RuleID, hit.DeviceID})
+		if err != nil {
+			return err
+		}
+		if err := putStateJSON(stub, key, hit); err != nil {
+			return err
+		}
+	}
+	hitsJSON, err := json.Marshal(hits)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent("ruleHits", hitsJSON)
+}
+
+// heldRuleStates returns, in order, the devices that have matched a
+// duration rule for at least its duration as of the event time at and have
+// not fired it yet.
+func heldRuleStates(r rule, tracked map[string]ruleState, at, local time.Time, mode string) []string {
+	if !r.applies(local, mode) {
+		return nil
+	}
+	var held []string
+	for deviceID, state := range tracked {
+		since, err := parseEventTime(state.Since)
+		if err != nil || state.Fired || at.Sub(since) < r.duration {
+			continue
+		}
+		held = append(held, deviceID)
+	}
+	sort.Strings(held)
+	return held
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		operator, want, value string
+		match                 bool
+	}{
+		{"==", "open", "open", true},
+		{"==", "open", "closed", false},
+		{"==", "5", "5.0", true},
+		{"!=", "5", "5.0", false},
+		{"!=", "open", "closed", true},
+		{"<", "5", "4.5", true},
+		{"<", "5", "5", false},
+		{"<=", "5", "5", true},
+		{">", "30", "31", true},
+		{">=", "30", "29.9", false},
+		{">", "30", "hot", false},
+	}
+	for _, tt := range tests {
+		r := rule{Operator: tt.operator, Value: tt.want}
+		if got := r.matches(tt.value); got != tt.match {
+			t.Errorf("%s %s %s = %v", tt.value, tt.operator, tt.want, got)
+		}
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		r    rule
+		ok   bool
+	}{
+		{"simple", rule{RuleID: "cold", Capability: "temperature", Operator: "<", Value: "5"}, true},
+		{"duration", rule{RuleID: "door", Capability: "contact", Operator: "==", Value: "open", For: "30m"}, true},
+		{"no id", rule{Capability: "contact", Operator: "==", Value: "open"}, false},
+		{"bad operator", rule{RuleID: "x", Capability: "motion", Operator: "~"}, false},
+		{"bad duration", rule{RuleID: "x", Capability: "motion", Operator: "==", For: "soon"}, false},
+		{"bad window", rule{RuleID: "x", Capability: "motion", Operator: "==", Window: &dailyWindow{Start: "25:00", End: "06:00"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.r.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate = %v", tt.name, err)
+		}
+	}
+}
+
+func TestHeldRuleStates(t *testing.T) {
+	r := rule{RuleID: "door", Capability: "contact", Operator: "==", Value: "open", For: "30m", Window: &dailyWindow{Start: "22:00", End: "06:00"}}
+	if err := r.validate(); err != nil {
+		t.Fatal(err)
+	}
+	tracked := map[string]ruleState{
+		"c2": {Since: "2018-08-15t22:00:00.000z"},
+		"c1": {Since: "2018-08-15t22:10:00.000z"},
+		"c3": {Since: "2018-08-15t22:30:00.000z"},
+		"c4": {Since: "2018-08-15t21:00:00.000z", Fired: true},
+	}
+	at := time.Date(2018, 8, 15, 22, 45, 0, 0, time.UTC)
+	if got, want := heldRuleStates(r, tracked, at, at, ""), []string{"c1", "c2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("heldRuleStates = %v, want %v", got, want)
+	}
+	outside := time.Date(2018, 8, 16, 7, 0, 0, 0, time.UTC)
+	if got := heldRuleStates(r, tracked, outside, outside, ""); len(got) != 0 {
+		t.Errorf("heldRuleStates outside the window = %v", got)
+	}
+	r.Mode = "away"
+	if got := heldRuleStates(r, tracked, at, at, "home"); len(got) != 0 {
+		t.Errorf("heldRuleStates in another mode = %v", got)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Signature statuses saveNewEvent stores on each event.
+const (
+	signatureUnsigned   = "unsigned"
+	signatureValid      = "valid"
+	signatureInvalid    = "invalid"
+	signatureUnknownKey = "unknownkey"
+	signatureRevokedKey = "revokedkey"
+)
+
+// hubKey is a public key a hub signs its events with, stored under the
+// hubkey composite key of locationId and keyId. Keys are never replaced;
+// a new key gets a new keyId and the old one is revoked. Keys are ECDSA or
+// Ed25519; the Go of the Fabric 1.2 chaincode environment predates
+// crypto/ed25519, so Ed25519 comes from the vendored golang.org/x/crypto.
+type hubKey struct {
+	DocType      string `json:"docType"`
+	LocationID   string `json:"locationId"`
+	KeyID        string `json:"keyId"`
+	Algorithm    string `json:"algorithm"`
+	PublicKey    string `json:"publicKey"`
+	RegisteredAt string `json:"registeredAt"`
+	RegisteredBy actor  `json:"registeredBy"`
+	Revoked      bool   `json:"revoked"`
+	RevokedAt    string `json:"revokedAt,omitempty"`
+	RevokedBy    *actor `json:"revokedBy,omitempty"`
+}
+
+// signingPolicy says whether a location only accepts events with a valid
+// signature, stored under the signing composite key of locationId.
+type signingPolicy struct {
+	DocType       string `json:"docType"`
+	LocationID    string `json:"locationId"`
+	RequireSigned bool   `json:"requireSigned"`
+}
+
+// oidEd25519 identifies Ed25519 keys in a PKIX public key (RFC 8410).
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+// publicKeyInfo is a PKIX SubjectPublicKeyInfo.
+type publicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// parseHubKey reads a PEM encoded PKIX public key and returns it, an
+// *ecdsa.PublicKey or an ed25519.PublicKey, and its algorithm, "ecdsa" or
+// "ed25519". Ed25519 keys are read here, as x509 only knows them from
+// Go 1.13 on.
+func parseHubKey(publicKey string) (interface{}, string, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return nil, "", errors.New("public key must be PEM encoded")
+	}
+	var info publicKeyInfo
+	if rest, err := asn1.Unmarshal(block.Bytes, &info); err == nil && len(rest) == 0 && info.Algorithm.Algorithm.Equal(oidEd25519) {
+		if len(info.PublicKey.Bytes) != ed25519.PublicKeySize || info.PublicKey.BitLength != 8*ed25519.PublicKeySize {
+			return nil, "", errors.New("invalid public key: Ed25519 keys are 32 bytes")
+		}
+		return ed25519.PublicKey(info.PublicKey.Bytes), "ed25519", nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, "", errors.New("invalid public key: " + err.Error())
+	}
+	if key, ok := key.(*ecdsa.PublicKey); ok {
+		return key, "ecdsa", nil
+	}
+	return nil, "", errors.New("public key must be ECDSA or Ed25519")
+}
+
+// getHubKey loads a registered hub key.
+func getHubKey(stub shim.ChaincodeStubInterface, locationId, keyID string) (string, hubKey, bool, error) {
+	var key hubKey
+	stateKey, err := stub.CreateCompositeKey("hubkey", []string{locationId, keyID})
+	if err != nil {
+		return "", key, false, err
+	}
+	found, err := getStateJSON(stub, stateKey, &key)
+	return stateKey, key, found, err
+}
+
+// registerHubKey registers the public key a hub of a location signs its
+// events with. Only administrators may call it (see requireAdmin).
+// Args: locationId, keyId, publicKey as a PEM encoded PKIX key.
+func (t *SimpleAsset) registerHubKey(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId, keyId and publicKey")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	locationId, keyID := args[0], args[1]
+	if keyID == "" {
+		return shim.Error("keyId must not be empty")
+	}
+	_, algorithm, err := parseHubKey(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	stateKey, _, found, err := getHubKey(stub, locationId, keyID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if found {
+		return shim.Error("Key " + keyID + " is already registered")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	by, err := getActor(stub)
+	if err != nil {
+		return shim.Error("Failed to get submitter identity: " + err.Error())
+	}
+
+	key := hubKey{
+		DocType:      "HubKey",
+		LocationID:   locationId,
+		KeyID:        keyID,
+		Algorithm:    algorithm,
+		PublicKey:    args[2],
+		RegisteredAt: now.Format(eventTimeLayout),
+		RegisteredBy: by,
+	}
+	if err := putStateJSON(stub, stateKey, key); err != nil {
+		return shim.Error("Failed to set hub key")
+	}
+	return successJSON(key)
+}
+
+// revokeHubKey revokes a hub key. Events signed with it are no longer
+// accepted as validly signed. Only administrators may call it.
+// Args: locationId, keyId.
+func (t *SimpleAsset) revokeHubKey(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and keyId")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	stateKey, key, found, err := getHubKey(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("Key " + args[1] + " is not registered")
+	}
+	if key.Revoked {
+		return shim.Error("Key " + args[1] + " is already revoked")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	by, err := getActor(stub)
+	if err != nil {
+		return shim.Error("Failed to get submitter identity: " + err.Error())
+	}
+
+	key.Revoked = true
+	key.RevokedAt = now.Format(eventTimeLayout)
+	key.RevokedBy = &by
+	if err := putStateJSON(stub, stateKey, key); err != nil {
+		return shim.Error("Failed to set hub key")
+	}
+	return successJSON(key)
+}
+
+// listHubKeys returns the hub keys of a location, revoked ones included.
+// Args: locationId.
+func (t *SimpleAsset) listHubKeys(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("hubkey", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	keys := []hubKey{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var key hubKey
+		if err := json.Unmarshal(queryResponse.Value, &key); err != nil {
+			return shim.Error(err.Error())
+		}
+		keys = append(keys, key)
+	}
+	return successJSON(keys)
+}
+
+// setRequireSigned sets whether a location only accepts events carrying a
+// valid signature from one of its hub keys. Only administrators may call
+// it.
+// Args: locationId, "true" or "false".
+func (t *SimpleAsset) setRequireSigned(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and requireSigned")
+	}
+	if err := requireAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	require, err := strconv.ParseBool(args[1])
+	if err != nil {
+		return shim.Error("requireSigned must be true or false")
+	}
+	key, err := stub.CreateCompositeKey("signing", []string{args[0]})
+	if err != nil {
+		return shim.Error("Failed to set composite key")
+	}
+	policy := signingPolicy{DocType: "SigningPolicy", LocationID: args[0], RequireSigned: require}
+	if err := putStateJSON(stub, key, policy); err != nil {
+		return shim.Error("Failed to set signing policy")
+	}
+	return successJSON(policy)
+}
+
+// requiresSignedEvents reports whether a location only accepts validly
+// signed events.
+func requiresSignedEvents(stub shim.ChaincodeStubInterface, locationId string) (bool, error) {
+	key, err := stub.CreateCompositeKey("signing", []string{locationId})
+	if err != nil {
+		return false, err
+	}
+	var policy signingPolicy
+	_, err = getStateJSON(stub, key, &policy)
+	return policy.RequireSigned, err
+}
+
+// signedMessage is what a hub signs: the JSON array of the 17 event fields
+// passed to saveNewEvent, exactly as passed.
+func signedMessage(fields []string) []byte {
+	message, _ := json.Marshal(fields)
+	return message
+}
+
+// verifyEventSignature checks the signature saveNewEvent was given over the
+// event fields against the location's hub key and returns the status to
+// store on the event. Signatures are passed base64 encoded: ECDSA ones are
+// over the SHA-256 of the message and ASN.1 DER encoded, Ed25519 ones are
+// over the message itself.
+func verifyEventSignature(stub shim.ChaincodeStubInterface, locationId, keyID, signature string, fields []string) (string, error) {
+	if keyID == "" && signature == "" {
+		return signatureUnsigned, nil
+	}
+	_, key, found, err := getHubKey(stub, locationId, keyID)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return signatureUnknownKey, nil
+	}
+	if key.Revoked {
+		return signatureRevokedKey, nil
+	}
+	publicKey, _, err := parseHubKey(key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return signatureInvalid, nil
+	}
+
+	if !verifySignature(publicKey, signedMessage(fields), sig) {
+		return signatureInvalid, nil
+	}
+	return signatureValid, nil
+}
+
+// verifySignature checks a signature over a message with a key returned by
+// parseHubKey.
+func verifySignature(publicKey interface{}, message, sig []byte) bool {
+	switch publicKey := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		return verifyECDSA(publicKey, message, sig)
+	case ed25519.PublicKey:
+		return len(sig) == ed25519.SignatureSize && ed25519.Verify(publicKey, message, sig)
+	}
+	return false
+}
+
+// verifyECDSA checks an ASN.1 DER encoded ECDSA signature over the SHA-256
+// of a message.
+func verifyECDSA(publicKey *ecdsa.PublicKey, message, sig []byte) bool {
+	var rs struct{ R, S *big.Int }
+	rest, err := asn1.Unmarshal(sig, &rs)
+	if err != nil || len(rest) != 0 || rs.R == nil || rs.S == nil {
+		return false
+	}
+	digest := sha256.Sum256(message)
+	return ecdsa.Verify(publicKey, digest[:], rs.R, rs.S)
+}
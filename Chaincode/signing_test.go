@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// ed25519PEM encodes an Ed25519 public key as a PEM PKIX key.
+func ed25519PEM(t *testing.T, key ed25519.PublicKey) string {
+	der, err := asn1.Marshal(publicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidEd25519},
+		PublicKey: asn1.BitString{Bytes: key, BitLength: 8 * len(key)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestVerifyECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	message := signedMessage([]string{"Lamp", "on"})
+	digest := sha256.Sum256(message)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+
+	tests := []struct {
+		name    string
+		key     *ecdsa.PublicKey
+		message []byte
+		sig     []byte
+		want    bool
+	}{
+		{"valid", &key.PublicKey, message, sig, true},
+		{"other key", &other.PublicKey, message, sig, false},
+		{"other message", &key.PublicKey, signedMessage([]string{"Lamp", "off"}), sig, false},
+		{"trailing bytes", &key.PublicKey, message, append(append([]byte{}, sig...), 0), false},
+		{"not DER", &key.PublicKey, message, []byte("signature"), false},
+		{"empty", &key.PublicKey, message, nil, false},
+	}
+	for _, tt := range tests {
+		if got := verifyECDSA(tt.key, tt.message, tt.sig); got != tt.want {
+			t.Errorf("%s: verifyECDSA() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseHubKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		publicKey string
+		want      string
+	}{
+		{"ecdsa", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), "ecdsa"},
+		{"ed25519", ed25519PEM(t, edKey), "ed25519"},
+		{"short ed25519", ed25519PEM(t, edKey[:31]), ""},
+		{"not PEM", "garbage", ""},
+		{"not a key", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("garbage")})), ""},
+	}
+	for _, tt := range tests {
+		_, algorithm, err := parseHubKey(tt.publicKey)
+		if (err == nil) != (tt.want != "") || algorithm != tt.want {
+			t.Errorf("%s: parseHubKey() = %q, %v", tt.name, algorithm, err)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	message := signedMessage([]string{"Lamp", "on"})
+	edSig := ed25519.Sign(edKey, message)
+	digest := sha256.Sum256(message)
+	r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+	ecSig, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+
+	tests := []struct {
+		name string
+		key  string
+		sig  []byte
+		want bool
+	}{
+		{"ed25519", ed25519PEM(t, edPub), edSig, true},
+		{"ed25519 other message", ed25519PEM(t, edPub), ed25519.Sign(edKey, signedMessage([]string{"Lamp", "off"})), false},
+		{"ed25519 short signature", ed25519PEM(t, edPub), edSig[:63], false},
+		{"ed25519 key, ecdsa signature", ed25519PEM(t, edPub), ecSig, false},
+		{"ecdsa", pemPKIX(t, &ecKey.PublicKey), ecSig, true},
+		{"ecdsa key, ed25519 signature", pemPKIX(t, &ecKey.PublicKey), edSig, false},
+	}
+	for _, tt := range tests {
+		key, _, err := parseHubKey(tt.key)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := verifySignature(key, message, tt.sig); got != tt.want {
+			t.Errorf("%s: verifySignature() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// pemPKIX encodes a public key x509 knows as a PEM PKIX key.
+func pemPKIX(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
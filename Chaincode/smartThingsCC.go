@@ -27,6 +27,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"strings"
 
@@ -38,6 +39,61 @@ import (
 type SimpleAsset struct {
 }
 
+// event is the Event document saveNewEvent stores under the combined
+// composite key of deviceId and time. SignatureStatus records whether the
+// hub signed the event (see signing.go), the private details are moved to
+// DetailsCollection (see privacy.go) unless the location encrypts fields
+// instead (see encryption.go), and Seq and PrevHash link the events of a
+// device into a hash chain (see chain.go). Events of numeric capabilities
+// also carry their parsed value and unit, and the value converted to the
+// capability's canonical unit (see values.go).
+type event struct {
+	DocType             string   `json:"docType"`
+	DisplayName         string   `json:"displayName"`
+	Device              string   `json:"device"`
+	IsStateChange       string   `json:"isStateChange"`
+	ID                  string   `json:"id"`
+	Description         string   `json:"description"`
+	DescriptionText     string   `json:"descriptionText"`
+	InstalledSmartAppID string   `json:"installedSmartAppId"`
+	IsDigital           string   `json:"isDigital"`
+	IsPhysical          string   `json:"isPhysical"`
+	DeviceID            string   `json:"deviceId"`
+	Location            string   `json:"location"`
+	LocationID          string   `json:"locationId"`
+	Source              string   `json:"source"`
+	Unit                string   `json:"unit"`
+	Value               string   `json:"value"`
+	NumericValue        *float64 `json:"numericValue,omitempty"`
+	NumericUnit         string   `json:"numericUnit,omitempty"`
+	CanonicalValue      *float64 `json:"canonicalValue,omitempty"`
+	CanonicalUnit       string   `json:"canonicalUnit,omitempty"`
+	Name                string   `json:"name"`
+	Time                string   `json:"time"`
+	Date                string   `json:"date"`
+	SignedBy            string   `json:"signedBy,omitempty"`
+	SignatureStatus     string   `json:"signatureStatus,omitempty"`
+	DetailsCollection   string   `json:"detailsCollection,omitempty"`
+	DetailsHash         string   `json:"detailsHash,omitempty"`
+	EncryptionKeyID     string   `json:"encryptionKeyId,omitempty"`
+	EncryptedFields     []string `json:"encryptedFields,omitempty"`
+	Seq                 int64    `json:"seq,omitempty"`
+	PrevHash            string   `json:"prevHash,omitempty"`
+}
+
+// eventLess is the latest state of a device, stored under its deviceId.
+// When the event hides its name and value they are left empty, Hidden is
+// set and EventKey points to the event.
+type eventLess struct {
+	DocType     string `json:"docType"`
+	DisplayName string `json:"displayName"`
+	Value       string `json:"value"`
+	Time        string `json:"time"`
+	LocationID  string `json:"locationId"`
+	Hidden      bool   `json:"hidden,omitempty"`
+	EventKey    string `json:"eventKey,omitempty"`
+}
+
 // Init is called during chaincode instantiation to initialize any
 // data. Note that chaincode upgrade also calls this function to reset
 // or to migrate data.
@@ -57,16 +113,112 @@ func (t *SimpleAsset) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 		return t.queryByDate(stub, args)
 	} else if function == "queryLocation" {
 		return t.queryLocation(stub, args)
+	} else if function == "queryLocationByCapability" {
+		return t.queryLocationByCapability(stub, args)
+	} else if function == "locationStateAt" {
+		return t.locationStateAt(stub, args)
+	} else if function == "timelineAround" {
+		return t.timelineAround(stub, args)
+	} else if function == "setLocationTimezone" {
+		return t.setLocationTimezone(stub, args)
+	} else if function == "setLocationOwner" {
+		return t.setLocationOwner(stub, args)
+	} else if function == "putTariffs" {
+		return t.putTariffs(stub, args)
+	} else if function == "getTariffs" {
+		return t.getTariffs(stub, args)
+	} else if function == "energyUsage" {
+		return t.energyUsage(stub, args)
+	} else if function == "lockAudit" {
+		return t.lockAudit(stub, args)
+	} else if function == "acknowledgeIncident" {
+		return t.acknowledgeIncident(stub, args)
+	} else if function == "resolveIncident" {
+		return t.resolveIncident(stub, args)
+	} else if function == "getIncident" {
+		return t.getIncident(stub, args)
+	} else if function == "listOpenIncidents" {
+		return t.listOpenIncidents(stub, args)
+	} else if function == "putRule" {
+		return t.putRule(stub, args)
+	} else if function == "deleteRule" {
+		return t.deleteRule(stub, args)
+	} else if function == "listRules" {
+		return t.listRules(stub, args)
+	} else if function == "queryRuleHits" {
+		return t.queryRuleHits(stub, args)
+	} else if function == "setReportingInterval" {
+		return t.setReportingInterval(stub, args)
+	} else if function == "queryStaleDevices" {
+		return t.queryStaleDevices(stub, args)
+	} else if function == "queryLowBatteries" {
+		return t.queryLowBatteries(stub, args)
+	} else if function == "batteryDrain" {
+		return t.batteryDrain(stub, args)
+	} else if function == "queryOccupancy" {
+		return t.queryOccupancy(stub, args)
+	} else if function == "setInactivityPolicy" {
+		return t.setInactivityPolicy(stub, args)
+	} else if function == "getInactivityPolicy" {
+		return t.getInactivityPolicy(stub, args)
+	} else if function == "checkInactivity" {
+		return t.checkInactivity(stub, args)
+	} else if function == "activityHistogram" {
+		return t.activityHistogram(stub, args)
+	} else if function == "queryByAutomation" {
+		return t.queryByAutomation(stub, args)
+	} else if function == "automationSummary" {
+		return t.automationSummary(stub, args)
+	} else if function == "deviceAliases" {
+		return t.deviceAliases(stub, args)
+	} else if function == "verifyDeviceChain" {
+		return t.verifyDeviceChain(stub, args)
+	} else if function == "sealDay" {
+		return t.sealDay(stub, args)
+	} else if function == "getInclusionProof" {
+		return t.getInclusionProof(stub, args)
+	} else if function == "registerHubKey" {
+		return t.registerHubKey(stub, args)
+	} else if function == "revokeHubKey" {
+		return t.revokeHubKey(stub, args)
+	} else if function == "listHubKeys" {
+		return t.listHubKeys(stub, args)
+	} else if function == "setRequireSigned" {
+		return t.setRequireSigned(stub, args)
+	} else if function == "setDetailsCollection" {
+		return t.setDetailsCollection(stub, args)
+	} else if function == "setPrivateDetails" {
+		return t.setPrivateDetails(stub, args)
+	} else if function == "setEncryptedFields" {
+		return t.setEncryptedFields(stub, args)
+	} else if function == "getEncryptedFields" {
+		return t.getEncryptedFields(stub, args)
+	} else if function == "eraseLocationData" {
+		return t.eraseLocationData(stub, args)
+	} else if function == "getErasureReceipts" {
+		return t.getErasureReceipts(stub, args)
+	} else if function == "setRetention" {
+		return t.setRetention(stub, args)
+	} else if function == "getRetention" {
+		return t.getRetention(stub, args)
+	} else if function == "pruneExpired" {
+		return t.pruneExpired(stub, args)
+	} else if function == "compactRange" {
+		return t.compactRange(stub, args)
+	} else if function == "queryByValueRange" {
+		return t.queryByValueRange(stub, args)
 	}
 
 	return shim.Error("Invalid function name for 'invoke'")
 }
 
 // saveNewEvent stores the event on the ledger. For each device
-// it will override the current state with the new one
+// it will override the current state with the new one.
+// The full event details may be followed by the keyId and signature of the
+// hub that signed them.
 func (t *SimpleAsset) saveNewEvent(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	if len(args) != 17 {
-		return shim.Error("incorrect arguments. Expecting full event details")
+	if len(args) != 17 && len(args) != 19 {
+		return shim.Error("incorrect arguments. Expecting full event details and optionally keyId and signature")
 	}
 
 	displayName := strings.ToLower(args[0])
@@ -89,41 +241,130 @@ func (t *SimpleAsset) saveNewEvent(stub shim.ChaincodeStubInterface, args []stri
 	date := strings.Replace(time, "-", "", -1)
 	date = strings.Split(date, "t")[0]
 
-	//Building the event json string manually without struct marshalling
-	eventJSONasString := `{"docType":"Event",  "displayName": "` + displayName + `",
-	 "device": "` + device + `", "isStateChange": "` + isStateChange + `",
-	 "id": "` + id + `", "description": "` + description + `",
-	 "descriptionText": "` + descriptionText + `", "installedSmartAppId": "` + installedSmartAppID + `",
-	 "isDigital": "` + isDigital + `", "isPhysical": "` + isPhysical + `", "deviceId": "` + deviceID + `",
-	 "location": "` + location + `", "locationId": "` + locationID + `", "source": "` + source + `",
-	 "unit": "` + unit + `", "value": "` + value + `", "name": "` + name + `", "time": "` + time + `", "date": "` + date + `"}`
-	eventJSONasBytes := []byte(eventJSONasString)
-
-	eventLessArgsString := `{"docType":"EventLess",  "displayName": "` + displayName + `", "value": "` + value + `",
-	 "time": "` + time + `", "locationId": "` + locationID + `"}`
-	eventLessArgs := []byte(eventLessArgsString)
-	err := stub.PutState(deviceID, eventLessArgs)
+	signedBy, signature := "", ""
+	if len(args) == 19 {
+		signedBy, signature = args[17], args[18]
+	}
+	signatureStatus, err := verifyEventSignature(stub, locationID, signedBy, signature, args[:17])
 	if err != nil {
-		return shim.Error("Failed to set asset")
+		return shim.Error("Failed to verify signature: " + err.Error())
+	}
+	requireSigned, err := requiresSignedEvents(stub, locationID)
+	if err != nil {
+		return shim.Error("Failed to get signing policy: " + err.Error())
 	}
+	if requireSigned && signatureStatus != signatureValid {
+		return shim.Error("Location requires signed events, signature is " + signatureStatus)
+	}
+
+	e := event{
+		DocType:             "Event",
+		DisplayName:         displayName,
+		Device:              device,
+		IsStateChange:       isStateChange,
+		ID:                  id,
+		Description:         description,
+		DescriptionText:     descriptionText,
+		InstalledSmartAppID: installedSmartAppID,
+		IsDigital:           isDigital,
+		IsPhysical:          isPhysical,
+		DeviceID:            deviceID,
+		Location:            location,
+		LocationID:          locationID,
+		Source:              source,
+		Unit:                unit,
+		Value:               value,
+		Name:                name,
+		Time:                time,
+		Date:                date,
+		SignedBy:            signedBy,
+		SignatureStatus:     signatureStatus,
+	}
+	e.setNumericValue()
 
 	arr := []string{deviceID, time}
 	myCompositeKey, err := stub.CreateCompositeKey("combined", arr)
 	if err != nil {
 		return shim.Error("Failed to set composite key")
 	}
-	err = stub.PutState(myCompositeKey, eventJSONasBytes)
+	latest := eventLess{DocType: "EventLess", DisplayName: displayName, Value: value, Time: time, LocationID: locationID}
+	policy, encrypted, err := loadEncryptionPolicy(stub, locationID)
+	if err != nil {
+		return shim.Error("Failed to get encryption policy: " + err.Error())
+	}
+	private, err := keepsDetailsPrivate(stub, locationID)
+	if err != nil {
+		return shim.Error("Failed to get privacy setting: " + err.Error())
+	}
+	public := e
+	var collection string
+	var details []byte
+	if encrypted {
+		if err := encryptEvent(stub, policy, myCompositeKey, &public); err != nil {
+			return shim.Error("Failed to encrypt event: " + err.Error())
+		}
+	} else if private {
+		if collection, err = callerCollection(stub); err != nil {
+			return shim.Error("Failed to get submitter identity: " + err.Error())
+		}
+		salt, err := detailsSalt(stub, myCompositeKey)
+		if err != nil {
+			return shim.Error("Failed to salt event details: " + err.Error())
+		}
+		if public, details, err = splitEvent(e, collection, salt); err != nil {
+			return shim.Error("Failed to marshal event details")
+		}
+	}
+	hidden := public.hidesDerived()
+	if hidden {
+		latest = eventLess{DocType: "EventLess", Time: time, LocationID: locationID, Hidden: true, EventKey: myCompositeKey}
+	}
+	if err := chainEvent(stub, myCompositeKey, &public); err != nil {
+		return shim.Error("Failed to chain event: " + err.Error())
+	}
+	eventJSONasBytes, err := json.Marshal(public)
+	if err != nil {
+		return shim.Error("Failed to marshal event")
+	}
+
+	eventLessArgs, err := json.Marshal(latest)
+	if err != nil {
+		return shim.Error("Failed to marshal event")
+	}
+	err = stub.PutState(deviceID, eventLessArgs)
 	if err != nil {
 		return shim.Error("Failed to set asset")
 	}
-	return shim.Success([]byte(device))
-}
 
-// main function starts up the chaincode in the container during instantiate
-func main() {
-	if err := shim.Start(new(SimpleAsset)); err != nil {
-		fmt.Printf("Error starting SimpleAsset chaincode: %s", err)
+	err = stub.PutState(myCompositeKey, eventJSONasBytes)
+	if err != nil {
+		return shim.Error("Failed to set asset")
+	}
+	if details != nil {
+		err = stub.PutPrivateData(collection, myCompositeKey, details)
+		if err != nil {
+			return shim.Error("Failed to set event details: " + err.Error())
+		}
+	}
+	if err := updateDeviceRecord(stub, e); err != nil {
+		return shim.Error("Failed to set device: " + err.Error())
 	}
+	if err := recordBattery(stub, myCompositeKey, e, hidden); err != nil {
+		return shim.Error("Failed to record battery: " + err.Error())
+	}
+	if err := trackIncident(stub, myCompositeKey, e, hidden); err != nil {
+		return shim.Error("Failed to track incident: " + err.Error())
+	}
+	if err := recordAutomation(stub, myCompositeKey, e, hidden); err != nil {
+		return shim.Error("Failed to record automation: " + err.Error())
+	}
+	if err := trackOccupancy(stub, myCompositeKey, e, hidden); err != nil {
+		return shim.Error("Failed to track occupancy: " + err.Error())
+	}
+	if err := evaluateRules(stub, myCompositeKey, e, hidden); err != nil {
+		return shim.Error("Failed to evaluate rules: " + err.Error())
+	}
+	return shim.Success([]byte(device))
 }
 
 // getQueryResultForQueryString retrieves the data from couchdb
@@ -142,6 +383,7 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 	var buffer bytes.Buffer
 	buffer.WriteString("[")
 
+	details := newDetailsReader(stub)
 	bArrayMemberAlreadyWritten := false
 	for resultsIterator.HasNext() {
 		queryResponse, err := resultsIterator.Next()
@@ -157,21 +399,28 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 		buffer.WriteString(queryResponse.Key)
 		buffer.WriteString("\"")
 
+		value, err := details.mergeRecord(queryResponse.Key, queryResponse.Value)
+		if err != nil {
+			return nil, err
+		}
 		buffer.WriteString(", \"Record\":")
 		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
+		buffer.WriteString(string(value))
 		buffer.WriteString("}")
 		bArrayMemberAlreadyWritten = true
 	}
 	buffer.WriteString("]")
 
-	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", buffer.String())
+	// The results may hold decrypted fields, which must not end up in the
+	// peer's logs.
+	fmt.Printf("- getQueryResultForQueryString returned %d bytes\n", buffer.Len())
 
 	return buffer.Bytes(), nil
 }
 
 // queryLocation creates a rich query to query the location using locationId.
 // It retrieve all the devices and their last states for that location.
+// The last states carry no capability or unit, so no output unit is taken.
 func (t *SimpleAsset) queryLocation(stub shim.ChaincodeStubInterface, args []string) peer.Response {
 
 	if len(args) < 1 {
@@ -180,13 +429,9 @@ func (t *SimpleAsset) queryLocation(stub shim.ChaincodeStubInterface, args []str
 
 	locationId := args[0]
 
-	queryString := fmt.Sprintf("{\r\n    \"selector\": {\r\n        \"docType\": \"EventLess\",\r\n        \"locationId\": \"%s\"\r\n    },\r\n    \"fields\": [\"displayName\", \"value\",\"time\"]\r\n}", locationId)
+	queryString := locationQuery.queryString([]string{locationId}, []string{"displayName", "value", "time", "hidden", "eventKey"})
 
 	queryResults, err := getQueryResultForQueryString(stub, queryString)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -194,23 +439,40 @@ func (t *SimpleAsset) queryLocation(stub shim.ChaincodeStubInterface, args []str
 }
 
 // queryByDate creates a rich query to query using locationId, deviceId and date.
-// It retrieves all the history of the device for a particular date.
+// It retrieves all the history of the device for a particular date, with
+// the device's hourly summaries standing in for the hours whose events were
+// compacted. An optional unit adds each reading converted to it.
 func (t *SimpleAsset) queryByDate(stub shim.ChaincodeStubInterface, args []string) peer.Response {
 
-	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 and optionally unit")
 	}
 
 	locationId := args[0]
 	deviceId := args[1]
 	date := args[2]
-	queryString := fmt.Sprintf("{\r\n    \"selector\": {\r\n        \"docType\": \"Event\",\r\n        \"locationId\": \"%s\",\r\n        \"deviceId\": \"%s\",\r\n        \"date\": \"%s\"\r\n    },\r\n    \"fields\": [\"value\",\"time\"]\r\n}", locationId, deviceId, date)
+	var unit string
+	if len(args) == 4 {
+		var err error
+		if unit, err = parseOutputUnit(args[3]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	queryString := dateQuery.queryString([]string{locationId, deviceId, date}, []string{"name", "value", "unit", "time", "numericValue", "numericUnit", "canonicalValue", "canonicalUnit", "encryptionKeyId", "encryptedFields"})
 
 	queryResults, err := getQueryResultForQueryString(stub, queryString)
-	queryResultsString := strings.Replace(string(queryResults), "\u0000", "||", -1)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	queryResultsString := strings.Replace(string(queryResults), "\u0000", "||", -1)
 	queryResults = []byte(queryResultsString)
+	if queryResults, err = withOutputUnit(queryResults, unit); err != nil {
+		return shim.Error(err.Error())
+	}
+	// Hours whose raw events were compacted are served from their hourly
+	// summaries.
+	if queryResults, err = withSummaries(stub, queryResults, locationId, deviceId, date, unit); err != nil {
+		return shim.Error(err.Error())
+	}
 	return shim.Success(queryResults)
 }
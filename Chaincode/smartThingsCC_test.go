@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// readStub records the keys a transaction reads, the way the peer records
+// its read set for the MVCC check at commit.
+type readStub struct {
+	*shim.MockStub
+	reads map[string]bool
+}
+
+func (s *readStub) GetState(key string) ([]byte, error) {
+	s.reads[key] = true
+	return s.MockStub.GetState(key)
+}
+
+func (s *readStub) GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := s.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	s.reads[prefix] = true
+	return s.MockStub.GetStateByPartialCompositeKey(objectType, keys)
+}
+
+// eventArgs returns the saveNewEvent arguments of a device event.
+func eventArgs(deviceID, name, value, unit, source, time string) []string {
+	return []string{"Multisensor", "multisensor 1", "true", deviceID + "-" + time, name + " is " + value, name + " is " + value, "app-1", "false", "true", deviceID, "Home", "location-1", source, unit, value, name, time}
+}
+
+// saveBlock saves events one after another like the transactions of one
+// block, and returns the composite key types of the keys an event read
+// that an earlier one in the block wrote. The peer would reject such an
+// event with MVCC_READ_CONFLICT.
+func saveBlock(t *testing.T, stub *shim.MockStub, events [][]string) []string {
+	written := map[string]bool{}
+	conflicts := map[string]bool{}
+	for i, args := range events {
+		txID := "tx" + string(rune('a'+i))
+		before := map[string][]byte{}
+		for key, value := range stub.State {
+			before[key] = value
+		}
+		reader := &readStub{MockStub: stub, reads: map[string]bool{}}
+		stub.MockTransactionStart(txID)
+		response := new(SimpleAsset).saveNewEvent(reader, args)
+		stub.MockTransactionEnd(txID)
+		if response.Status != shim.OK {
+			t.Fatalf("saveNewEvent(%v): %s", args, response.Message)
+		}
+		for key := range reader.reads {
+			for w := range written {
+				if strings.HasPrefix(w, key) {
+					objectType, _, _ := stub.SplitCompositeKey(w)
+					conflicts[objectType] = true
+				}
+			}
+		}
+		for key, value := range stub.State {
+			if string(before[key]) != string(value) {
+				written[key] = true
+			}
+		}
+	}
+	var types []string
+	for objectType := range conflicts {
+		types = append(types, objectType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func TestSaveNewEventSameBlock(t *testing.T) {
+	stub := shim.NewMockStub("smartthings", new(SimpleAsset))
+	conflicts := saveBlock(t, stub, [][]string{
+		eventArgs("device-1", "temperature", "21", "C", "DEVICE", "2018-08-15T01:00:00.000Z"),
+		eventArgs("device-1", "motion", "active", "", "DEVICE", "2018-08-15T01:00:01.000Z"),
+		eventArgs("device-1", "motion", "inactive", "", "DEVICE", "2018-08-15T01:00:01.500Z"),
+		eventArgs("device-1", "battery", "81", "%", "DEVICE", "2018-08-15T01:00:02.000Z"),
+		eventArgs("device-1", "battery", "80", "%", "DEVICE", "2018-08-15T01:00:03.000Z"),
+	})
+	// Only the device's hash chain orders its events; clients retry the
+	// events that conflict on it (see chainEvent).
+	if !reflect.DeepEqual(conflicts, []string{"chainhead"}) {
+		t.Errorf("events of one device in a block conflict on %v, want only the chain head", conflicts)
+	}
+
+	record, found, err := getDeviceRecord(stub, "device-1")
+	if err != nil || !found {
+		t.Fatalf("getDeviceRecord() = %v, %v", found, err)
+	}
+	want := map[string]string{
+		"temperature": "2018-08-15t01:00:00.000z",
+		"motion":      "2018-08-15t01:00:01.500z",
+		"battery":     "2018-08-15t01:00:03.000z",
+	}
+	if record.LocationID != "location-1" || len(record.Capabilities) != len(want) {
+		t.Fatalf("device record = %+v", record)
+	}
+	for name, at := range want {
+		if record.Capabilities[name] != at {
+			t.Errorf("%s last reported at %s, want %s", name, record.Capabilities[name], at)
+		}
+	}
+
+	var latest eventLess
+	if err := json.Unmarshal(stub.State["device-1"], &latest); err != nil || latest.Value != "80" {
+		t.Errorf("latest state = %s", stub.State["device-1"])
+	}
+	readings, err := getBatteryReadings(stub, "device-1")
+	if err != nil || len(readings) != 2 || readings[1].Level != 80 {
+		t.Errorf("battery readings = %+v, %v", readings, err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// capabilityState is the last reported value of one capability of a device.
+type capabilityState struct {
+	Value          string   `json:"value"`
+	Unit           string   `json:"unit"`
+	Time           string   `json:"time"`
+	ConvertedValue *float64 `json:"convertedValue,omitempty"`
+	ConvertedUnit  string   `json:"convertedUnit,omitempty"`
+}
+
+// deviceSnapshot is the state of a device at a point in time. States is
+// empty for devices that had not reported anything yet.
+type deviceSnapshot struct {
+	DeviceID    string                     `json:"deviceId"`
+	DisplayName string                     `json:"displayName"`
+	LastTime    string                     `json:"lastTime"`
+	States      map[string]capabilityState `json:"states"`
+}
+
+// locationSnapshot is the state of every device of a location at a time.
+type locationSnapshot struct {
+	LocationID string           `json:"locationId"`
+	At         string           `json:"at"`
+	Devices    []deviceSnapshot `json:"devices"`
+}
+
+// locationStateAt returns the state every device of a location was in at
+// the given time. For each capability in the device's record it reads the
+// most recent event at or before the time, so the work done grows with the
+// number of capabilities rather than with the length of the history.
+// Devices that have not logged anything since records were introduced have
+// no record; their events up to the time are read newest first instead.
+// An optional unit adds each reading converted to it.
+// Args: locationId, timestamp and optionally unit.
+func (t *SimpleAsset) locationStateAt(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId, timestamp and optionally unit")
+	}
+
+	locationId := args[0]
+	at, err := normalizeTime(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var unit string
+	if len(args) == 3 {
+		if unit, err = parseOutputUnit(args[2]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	devices, err := getLocationDevices(stub, locationId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	details := newDetailsReader(stub)
+	snapshot := locationSnapshot{LocationID: locationId, At: at, Devices: []deviceSnapshot{}}
+	for _, device := range devices {
+		state := deviceSnapshot{
+			DeviceID:    device.DeviceID,
+			DisplayName: device.Latest.DisplayName,
+			States:      map[string]capabilityState{},
+		}
+		var mergeErr error
+		visit := func(key string, e event) bool {
+			if _, seen := state.States[e.Name]; seen {
+				return true
+			}
+			if mergeErr = details.merge(key, &e); mergeErr != nil {
+				return false
+			}
+			if e.Time > state.LastTime {
+				state.DisplayName = e.DisplayName
+				state.LastTime = e.Time
+			}
+			converted, convertedUnit := e.convertedTo(unit)
+			state.States[e.Name] = capabilityState{Value: e.Value, Unit: e.Unit, Time: e.Time, ConvertedValue: converted, ConvertedUnit: convertedUnit}
+			return true
+		}
+
+		record, found, err := getDeviceRecord(stub, device.DeviceID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if found {
+			for _, name := range sortedCapabilities(record) {
+				values := []string{locationId, device.DeviceID, name}
+				if err = getEvents(stub, readingQuery.lastQueryString(values, at), visit); err != nil || mergeErr != nil {
+					break
+				}
+			}
+		} else {
+			values := []string{locationId, device.DeviceID}
+			err = getEvents(stub, deviceQuery.sortedQueryString(values, "", at, nil, nil, "desc", 0), visit)
+		}
+		if err == nil {
+			err = mergeErr
+		}
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		snapshot.Devices = append(snapshot.Devices, state)
+	}
+
+	return successJSON(snapshot)
+}
+
+// sortedCapabilities lists the capabilities a device has reported in name
+// order.
+func sortedCapabilities(record deviceRecord) []string {
+	names := make([]string, 0, len(record.Capabilities))
+	for name := range record.Capabilities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// defaultReportingInterval applies to capabilities without their own.
+const defaultReportingInterval = 24 * time.Hour
+
+// reportingIntervals is how often a device with a capability is expected to
+// report. Sensors that report measurements periodically get short
+// intervals; event driven sensors rely on their daily health check.
+var reportingIntervals = map[string]time.Duration{
+	"temperature": 2 * time.Hour,
+	"humidity":    2 * time.Hour,
+	"power":       1 * time.Hour,
+	"energy":      2 * time.Hour,
+	"battery":     26 * time.Hour,
+}
+
+// reportingInterval overrides the expected reporting interval of a device,
+// stored under the interval composite key of deviceId.
+type reportingInterval struct {
+	DocType  string `json:"docType"`
+	DeviceID string `json:"deviceId"`
+	Interval string `json:"interval"`
+}
+
+// staleDevice is a device that has been silent for longer than expected.
+type staleDevice struct {
+	DeviceID      string   `json:"deviceId"`
+	DisplayName   string   `json:"displayName"`
+	LastTime      string   `json:"lastTime"`
+	Interval      string   `json:"interval"`
+	SilentFor     string   `json:"silentFor"`
+	SilentSeconds int64    `json:"silentSeconds"`
+	Capabilities  []string `json:"capabilities"`
+}
+
+// setReportingInterval sets how often a device is expected to report,
+// replacing the default of its capabilities.
+// Args: deviceId, interval, e.g. "6h".
+func (t *SimpleAsset) setReportingInterval(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting deviceId and interval")
+	}
+
+	interval, err := parseWindow(args[1])
+	if err != nil || interval == 0 {
+		return shim.Error("interval must be a positive duration such as 6h")
+	}
+	key, err := stub.CreateCompositeKey("interval", []string{args[0]})
+	if err != nil {
+		return shim.Error("Failed to set composite key")
+	}
+	ri := reportingInterval{DocType: "ReportingInterval", DeviceID: args[0], Interval: interval.String()}
+	if err := putStateJSON(stub, key, ri); err != nil {
+		return shim.Error("Failed to set reporting interval")
+	}
+	return successJSON(ri)
+}
+
+// expectedInterval returns how often a device is expected to report: its
+// own interval if one was set, otherwise the shortest default among the
+// capabilities it has reported.
+func expectedInterval(stub shim.ChaincodeStubInterface, record deviceRecord) (time.Duration, error) {
+	key, err := stub.CreateCompositeKey("interval", []string{record.DeviceID})
+	if err != nil {
+		return 0, err
+	}
+	var ri reportingInterval
+	found, err := getStateJSON(stub, key, &ri)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		return time.ParseDuration(ri.Interval)
+	}
+
+	return record.defaultInterval(), nil
+}
+
+// defaultInterval returns the shortest default reporting interval among
+// the capabilities a device has reported.
+func (r deviceRecord) defaultInterval() time.Duration {
+	interval := defaultReportingInterval
+	for name := range r.Capabilities {
+		if d, ok := reportingIntervals[name]; ok && d < interval {
+			interval = d
+		}
+	}
+	return interval
+}
+
+// queryStaleDevices lists the devices of a location whose last event is
+// older than their expected reporting interval, longest silent first.
+// Args: locationId and optionally asOf, which defaults to the transaction
+// time.
+func (t *SimpleAsset) queryStaleDevices(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId and optionally asOf")
+	}
+
+	asOf, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) == 2 && args[1] != "" {
+		normalized, err := normalizeTime(args[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		asOf, _ = parseEventTime(normalized)
+	}
+
+	devices, err := getLocationDevices(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	stale := []staleDevice{}
+	for _, device := range devices {
+		// Location level events such as mode changes are not a device.
+		if device.DeviceID == locationDeviceID {
+			continue
+		}
+		last, err := parseEventTime(device.Latest.Time)
+		if err != nil {
+			continue
+		}
+		record, _, err := getDeviceRecord(stub, device.DeviceID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		record.DeviceID = device.DeviceID
+		interval, err := expectedInterval(stub, record)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		silent := asOf.Sub(last)
+		if silent <= interval {
+			continue
+		}
+		capabilities := []string{}
+		for name := range record.Capabilities {
+			capabilities = append(capabilities, name)
+		}
+		sort.Strings(capabilities)
+		stale = append(stale, staleDevice{
+			DeviceID:      device.DeviceID,
+			DisplayName:   device.Latest.DisplayName,
+			LastTime:      device.Latest.Time,
+			Interval:      interval.String(),
+			SilentFor:     silent.Truncate(time.Second).String(),
+			SilentSeconds: int64(silent / time.Second),
+			Capabilities:  capabilities,
+		})
+	}
+	sort.SliceStable(stale, func(i, j int) bool { return stale[i].SilentSeconds > stale[j].SilentSeconds })
+
+	return successJSON(stale)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDefaultInterval(t *testing.T) {
+	tests := []struct {
+		capabilities []string
+		want         time.Duration
+	}{
+		{nil, defaultReportingInterval},
+		{[]string{"contact"}, defaultReportingInterval},
+		{[]string{"contact", "battery"}, defaultReportingInterval},
+		{[]string{"temperature", "battery"}, 2 * time.Hour},
+		{[]string{"temperature", "power", "energy"}, time.Hour},
+	}
+	for _, tt := range tests {
+		record := deviceRecord{Capabilities: map[string]string{}}
+		for _, name := range tt.capabilities {
+			record.Capabilities[name] = "2018-08-15t10:00:00.000z"
+		}
+		if got := record.defaultInterval(); got != tt.want {
+			t.Errorf("defaultInterval(%v) = %s, want %s", tt.capabilities, got, tt.want)
+		}
+	}
+}
+
+func TestLastReported(t *testing.T) {
+	record := deviceRecord{Capabilities: map[string]string{
+		"contact":     "2018-08-15t10:00:00.000z",
+		"battery":     "2018-08-16t01:00:00.000z",
+		"temperature": "2018-08-15t23:59:00.000z",
+	}}
+	if got := record.lastReported(); got != "2018-08-16t01:00:00.000z" {
+		t.Errorf("lastReported = %s", got)
+	}
+	if got := (deviceRecord{}).lastReported(); got != "" {
+		t.Errorf("lastReported of an empty record = %q", got)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// getStateJSON reads the JSON document stored under key into v. It reports
+// false when nothing is stored under the key.
+func getStateJSON(stub shim.ChaincodeStubInterface, key string, v interface{}) (bool, error) {
+	valueJSON, err := stub.GetState(key)
+	if err != nil {
+		return false, err
+	}
+	if valueJSON == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(valueJSON, v)
+}
+
+// putStateJSON stores v as a JSON document under key.
+func putStateJSON(stub shim.ChaincodeStubInterface, key string, v interface{}) error {
+	valueJSON, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, valueJSON)
+}
+
+// successJSON returns v marshalled as the response payload.
+func successJSON(v interface{}) peer.Response {
+	valueJSON, err := json.Marshal(v)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(valueJSON)
+}
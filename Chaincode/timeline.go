@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// timelineEntry is one event of a location timeline, tagged with the device
+// and capability it came from. Location level events such as mode changes
+// are not tied to a device and have LocationEvent set.
+type timelineEntry struct {
+	Key             string   `json:"key"`
+	Time            string   `json:"time"`
+	DeviceID        string   `json:"deviceId"`
+	DisplayName     string   `json:"displayName"`
+	Capability      string   `json:"capability"`
+	Value           string   `json:"value"`
+	Unit            string   `json:"unit"`
+	DescriptionText string   `json:"descriptionText"`
+	LocationEvent   bool     `json:"locationEvent"`
+	ConvertedValue  *float64 `json:"convertedValue,omitempty"`
+	ConvertedUnit   string   `json:"convertedUnit,omitempty"`
+}
+
+// timelineAround returns every event of a location, from all devices and
+// the location itself, in a window around a moment, ordered by time.
+// An optional unit adds each reading converted to it.
+// Args: locationId, timestamp, windowBefore, windowAfter and optionally
+// unit. Windows are durations such as "15m" or "1h30m".
+func (t *SimpleAsset) timelineAround(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 4 && len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId, timestamp, windowBefore, windowAfter and optionally unit")
+	}
+
+	locationId := args[0]
+	at, err := normalizeTime(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	before, err := parseWindow(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	after, err := parseWindow(args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var unit string
+	if len(args) == 5 {
+		if unit, err = parseOutputUnit(args[4]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	moment, _ := time.Parse(eventTimeLayout, at)
+	from := moment.Add(-before).Format(eventTimeLayout)
+	to := moment.Add(after).Format(eventTimeLayout)
+	queryString := timelineQuery.rangeQueryString([]string{locationId}, from, to, nil, nil)
+
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	details := newDetailsReader(stub)
+	timeline := []timelineEntry{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var e event
+		if err := json.Unmarshal(queryResponse.Value, &e); err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := details.merge(queryResponse.Key, &e); err != nil {
+			return shim.Error(err.Error())
+		}
+		entry := timelineEntry{
+			Key:             queryResponse.Key,
+			Time:            e.Time,
+			DeviceID:        e.DeviceID,
+			DisplayName:     e.DisplayName,
+			Capability:      e.Name,
+			Value:           e.Value,
+			Unit:            e.Unit,
+			DescriptionText: e.DescriptionText,
+			LocationEvent:   e.DeviceID == "" || e.DeviceID == locationDeviceID,
+		}
+		entry.ConvertedValue, entry.ConvertedUnit = e.convertedTo(unit)
+		timeline = append(timeline, entry)
+	}
+
+	return successJSON(timeline)
+}
+
+// parseWindow reads a non-negative duration argument.
+func parseWindow(arg string) (time.Duration, error) {
+	window, err := time.ParseDuration(arg)
+	if err != nil || window < 0 {
+		return 0, fmt.Errorf("invalid window %q, expecting a duration such as 15m", arg)
+	}
+	return window, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want time.Duration
+		ok   bool
+	}{
+		{"15m", 15 * time.Minute, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"0s", 0, true},
+		{"-5m", 0, false},
+		{"15", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseWindow(tt.arg)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseWindow(%q) = %v, %v", tt.arg, got, err)
+		}
+	}
+}
+
+func TestNormalizeTime(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+		ok   bool
+	}{
+		{"2018-08-15T03:12:00Z", "2018-08-15t03:12:00.000z", true},
+		{"2018-08-15t03:12:00.5z", "2018-08-15t03:12:00.500z", true},
+		{"2018-08-15T05:12:00+02:00", "2018-08-15t03:12:00.000z", true},
+		{"2018-08-15", "", false},
+		{"yesterday", "", false},
+	}
+	for _, tt := range tests {
+		got, err := normalizeTime(tt.arg)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("normalizeTime(%q) = %q, %v", tt.arg, got, err)
+		}
+	}
+}
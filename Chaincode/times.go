@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// eventTimeLayout is the format of the time field saved with each event:
+// the SmartThings isoDate lowercased by saveNewEvent. Stored times sort
+// lexicographically in time order.
+const eventTimeLayout = "2006-01-02t15:04:05.000z"
+
+// parseEventTime parses a stored event time.
+func parseEventTime(value string) (time.Time, error) {
+	return time.Parse(eventTimeLayout, value)
+}
+
+// normalizeTime converts an RFC 3339 time argument into the stored event
+// time format so it can be compared against stored times.
+func normalizeTime(arg string) (string, error) {
+	parsed, err := time.Parse(time.RFC3339Nano, strings.ToUpper(arg))
+	if err != nil {
+		return "", fmt.Errorf("invalid time %q, expecting RFC 3339", arg)
+	}
+	return parsed.UTC().Format(eventTimeLayout), nil
+}
+
+// txTime returns the transaction timestamp, which is the same on every
+// endorsing peer, as opposed to the peer's clock.
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// dailyWindow is a time of day window such as "22:00" to "06:00", in the
+// location's timezone. A window whose end is before its start runs
+// overnight. Days limits the window to some weekdays ("mon" ... "sun");
+// empty means every day. resolve has to be called before contains.
+type dailyWindow struct {
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	Days  []string `json:"days,omitempty"`
+
+	startMinute, endMinute int
+}
+
+// resolve checks the window and computes its start and end minutes.
+func (w *dailyWindow) resolve() error {
+	var err error
+	if w.startMinute, err = parseMinuteOfDay(w.Start); err != nil {
+		return err
+	}
+	if w.endMinute, err = parseMinuteOfDay(w.End); err != nil {
+		return err
+	}
+	for _, day := range w.Days {
+		if _, ok := weekdays[day]; !ok {
+			return fmt.Errorf("invalid day %q", day)
+		}
+	}
+	return nil
+}
+
+// parseMinuteOfDay parses a "15:04" time of day into minutes after midnight.
+func parseMinuteOfDay(value string) (int, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expecting HH:MM", value)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// contains reports whether the window applies at the local time t.
+func (w dailyWindow) contains(t time.Time) bool {
+	if len(w.Days) > 0 {
+		onDay := false
+		for _, day := range w.Days {
+			if weekdays[day] == t.Weekday() {
+				onDay = true
+			}
+		}
+		if !onDay {
+			return false
+		}
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if w.startMinute <= w.endMinute {
+		return minute >= w.startMinute && minute < w.endMinute
+	}
+	return minute >= w.startMinute || minute < w.endMinute
+}
+
+// nextEdge returns the first time after t, in t's location, at which a new
+// day starts or one of the windows starts or ends.
+func nextEdge(t time.Time, windows []dailyWindow) time.Time {
+	year, month, day := t.Date()
+	next := time.Date(year, month, day+1, 0, 0, 0, 0, t.Location())
+	for _, w := range windows {
+		for _, minute := range []int{w.startMinute, w.endMinute} {
+			edge := time.Date(year, month, day, minute/60, minute%60, 0, 0, t.Location())
+			if edge.After(t) && edge.Before(next) {
+				next = edge
+			}
+		}
+	}
+	return next
+}
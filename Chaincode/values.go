@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// numericCapabilities are the attributes, as lowercased by saveNewEvent,
+// whose values are numbers. Their events carry the parsed numericValue.
+var numericCapabilities = map[string]bool{
+	"temperature": true, "humidity": true, "illuminance": true, "power": true, "energy": true,
+	"battery": true, "level": true, "voltage": true, "ultravioletindex": true,
+	"carbondioxide": true, "soundpressurelevel": true, "colortemperature": true,
+	"heatingsetpoint": true, "coolingsetpoint": true, "thermostatsetpoint": true,
+	"hue": true, "saturation": true,
+}
+
+// unitSpellings maps the ways hubs spell units, lowercased, to one
+// spelling. Units not listed are kept as they are.
+var unitSpellings = map[string]string{
+	"f": "F", "°f": "F", "fahrenheit": "F",
+	"c": "C", "°c": "C", "celsius": "C",
+	"w": "W", "watt": "W", "watts": "W",
+	"kw": "kW", "kilowatt": "kW", "kilowatts": "kW",
+	"wh": "Wh", "kwh": "kWh",
+	"v": "V", "volt": "V", "volts": "V",
+	"lux": "lux", "lx": "lux",
+	"%": "%", "percent": "%",
+	"ppm": "ppm", "db": "dB", "k": "K",
+}
+
+// unitConversion expresses a unit in the base unit of its quantity:
+// base = (value + offset) * scale.
+type unitConversion struct {
+	quantity      string
+	scale, offset float64
+}
+
+// unitConversions lists the units readings can be converted between.
+var unitConversions = map[string]unitConversion{
+	"C":   {"temperature", 1, 0},
+	"F":   {"temperature", 5.0 / 9, -32},
+	"K":   {"temperature", 1, -273.15},
+	"W":   {"power", 1, 0},
+	"kW":  {"power", 1000, 0},
+	"Wh":  {"energy", 1, 0},
+	"kWh": {"energy", 1000, 0},
+}
+
+// capabilityUnit is the canonical unit of a capability, and the unit its
+// readings are taken to be in when they come without one. An empty
+// fallback leaves such readings unconverted.
+type capabilityUnit struct {
+	canonical, fallback string
+}
+
+// capabilityUnits lists the capabilities whose readings are converted to a
+// canonical unit. Other numeric capabilities keep the unit they came in.
+var capabilityUnits = map[string]capabilityUnit{
+	"temperature":        {"C", ""},
+	"heatingsetpoint":    {"C", ""},
+	"coolingsetpoint":    {"C", ""},
+	"thermostatsetpoint": {"C", ""},
+	"power":              {"W", "W"},
+	"energy":             {"kWh", "kWh"},
+}
+
+// convertUnit converts a value between two units of the same quantity.
+// The result is rounded to 12 significant digits so that converting back
+// and forth gives the reading back.
+func convertUnit(value float64, from, to string) (float64, error) {
+	if from == to {
+		return value, nil
+	}
+	source, okSource := unitConversions[from]
+	target, okTarget := unitConversions[to]
+	if !okSource || !okTarget || source.quantity != target.quantity {
+		return 0, fmt.Errorf("cannot convert %q to %q", from, to)
+	}
+	converted := (value+source.offset)*source.scale/target.scale - target.offset
+	return strconv.ParseFloat(strconv.FormatFloat(converted, 'g', 12, 64), 64)
+}
+
+// normalizeUnit returns the single spelling of a unit.
+func normalizeUnit(unit string) string {
+	unit = strings.TrimSpace(strings.ToLower(unit))
+	if normalized, ok := unitSpellings[unit]; ok {
+		return normalized
+	}
+	return unit
+}
+
+// parseNumericValue parses the value of an event of a numeric capability.
+// It reports false for other capabilities and values that are not finite
+// numbers.
+func parseNumericValue(name, value string) (float64, bool) {
+	if !numericCapabilities[name] {
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return 0, false
+	}
+	return number, true
+}
+
+// setNumericValue fills in the numeric value and normalized unit of an
+// event of a numeric capability, and the value in the capability's
+// canonical unit. Readings in a unit that cannot be converted get no
+// canonical value.
+func (e *event) setNumericValue() {
+	number, ok := parseNumericValue(e.Name, e.Value)
+	if !ok {
+		return
+	}
+	e.NumericValue = &number
+	e.NumericUnit = normalizeUnit(e.Unit)
+	units, converted := capabilityUnits[e.Name]
+	if e.NumericUnit == "" {
+		e.NumericUnit = units.fallback
+	}
+	if !converted {
+		e.CanonicalValue, e.CanonicalUnit = e.NumericValue, e.NumericUnit
+		return
+	}
+	canonical, err := convertUnit(number, e.NumericUnit, units.canonical)
+	if err != nil {
+		return
+	}
+	e.CanonicalValue, e.CanonicalUnit = &canonical, units.canonical
+}
+
+// valueIn returns the event's reading in the given unit. Events stored
+// before their numeric value was kept are parsed on the fly.
+func (e event) valueIn(unit string) (float64, bool) {
+	if e.NumericValue == nil {
+		e.setNumericValue()
+	}
+	if e.NumericValue == nil {
+		return 0, false
+	}
+	value, err := convertUnit(*e.NumericValue, e.NumericUnit, unit)
+	return value, err == nil
+}
+
+// convertedTo returns the event's reading in an output unit and the unit,
+// or nil when there is no output unit or the reading cannot be converted.
+func (e event) convertedTo(unit string) (*float64, string) {
+	if unit == "" {
+		return nil, ""
+	}
+	value, ok := e.valueIn(unit)
+	if !ok {
+		return nil, ""
+	}
+	return &value, unit
+}
+
+// parseOutputUnit reads an optional output unit argument.
+func parseOutputUnit(arg string) (string, error) {
+	if arg == "" {
+		return "", nil
+	}
+	unit := normalizeUnit(arg)
+	if _, ok := unitConversions[unit]; !ok {
+		return "", fmt.Errorf("unknown unit %q", arg)
+	}
+	return unit, nil
+}
+
+// withOutputUnit adds the convertedValue and convertedUnit of every event
+// record of a query response whose reading can be converted to unit. The
+// records need the name, value and unit of the event, and its numericValue
+// and numericUnit where stored. The response is either an array of records
+// or a page holding them under Records; keys must already be valid JSON.
+func withOutputUnit(results []byte, unit string) ([]byte, error) {
+	if unit == "" {
+		return results, nil
+	}
+	type record struct {
+		Key    string                 `json:"Key"`
+		Record map[string]interface{} `json:"Record"`
+	}
+	var page struct {
+		Records          []record        `json:"Records"`
+		ResponseMetadata json.RawMessage `json:"ResponseMetadata"`
+	}
+	records := &page.Records
+	paged := bytes.HasPrefix(results, []byte("{"))
+	var err error
+	if paged {
+		err = json.Unmarshal(results, &page)
+	} else {
+		err = json.Unmarshal(results, records)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range *records {
+		recordJSON, err := json.Marshal(r.Record)
+		if err != nil {
+			return nil, err
+		}
+		var e event
+		if err := json.Unmarshal(recordJSON, &e); err != nil {
+			continue
+		}
+		if converted, convertedUnit := e.convertedTo(unit); converted != nil {
+			r.Record["convertedValue"] = *converted
+			r.Record["convertedUnit"] = convertedUnit
+		}
+	}
+	if paged {
+		return json.Marshal(page)
+	}
+	return json.Marshal(*records)
+}
+
+// parseBound reads an optional numeric bound argument given in unit,
+// converts it to the canonical unit and formats it so it can be written
+// into a query. An empty unit takes the bound to be canonical already.
+func parseBound(arg, unit, canonical string) (string, error) {
+	if arg == "" {
+		return "", nil
+	}
+	number, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return "", strconv.ErrSyntax
+	}
+	if unit != "" {
+		if number, err = convertUnit(number, unit, canonical); err != nil {
+			return "", err
+		}
+	}
+	return strconv.FormatFloat(number, 'g', -1, 64), nil
+}
+
+// queryByValueRange returns the events of one numeric capability across a
+// location whose value lies between min and max, between two times,
+// ordered by value. An empty min or max leaves that end open. min and max
+// are in the capability's canonical unit, or in the output unit if one is
+// given, which the results are then also converted to. The range is read
+// from the canonicalValue index, so events without a canonical value are
+// never returned: events saved before values were parsed, readings whose
+// value is not a number and temperatures sent without a unit or in one
+// that cannot be converted.
+// Args: locationId, name, min, max, from, to and optionally unit.
+func (t *SimpleAsset) queryByValueRange(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+
+	if len(args) != 6 && len(args) != 7 {
+		return shim.Error("Incorrect number of arguments. Expecting locationId, name, min, max, from, to and optionally unit")
+	}
+
+	locationId := args[0]
+	name := strings.ToLower(args[1])
+	if !numericCapabilities[name] {
+		return shim.Error(name + " is not a numeric capability")
+	}
+	var unit string
+	if len(args) == 7 {
+		var err error
+		if unit, err = parseOutputUnit(args[6]); err != nil {
+			return shim.Error(err.Error())
+		}
+		if unit != "" {
+			if _, err := convertUnit(0, capabilityUnits[name].canonical, unit); err != nil {
+				return shim.Error(name + " values are not converted to " + unit)
+			}
+		}
+	}
+	min, err := parseBound(args[2], unit, capabilityUnits[name].canonical)
+	if err != nil {
+		return shim.Error("min must be a number")
+	}
+	max, err := parseBound(args[3], unit, capabilityUnits[name].canonical)
+	if err != nil {
+		return shim.Error("max must be a number")
+	}
+	from, err := normalizeTime(args[4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := normalizeTime(args[5])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	filters := []queryFilter{{field: "time", from: from, to: to}}
+	queryString := valueQuery.rangeQueryString([]string{locationId, name}, min, max, filters, nil)
+	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	queryResults = []byte(strings.Replace(string(queryResults), "\u0000", "||", -1))
+	if queryResults, err = withOutputUnit(queryResults, unit); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
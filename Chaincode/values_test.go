@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestSetNumericValue(t *testing.T) {
+	tests := []struct {
+		name, value, unit string
+		numeric           bool
+		numericValue      float64
+		numericUnit       string
+		canonical         bool
+		canonicalValue    float64
+		canonicalUnit     string
+	}{
+		{"temperature", "71.6", "°f", true, 71.6, "F", true, 22, "C"},
+		{"temperature", "22", "c", true, 22, "C", true, 22, "C"},
+		{"temperature", "22", "", true, 22, "", false, 0, ""},
+		{"temperature", "22", "furlong", true, 22, "furlong", false, 0, ""},
+		{"power", "1.5", "kw", true, 1.5, "kW", true, 1500, "W"},
+		{"power", "250", "", true, 250, "W", true, 250, "W"},
+		{"energy", "1200", "wh", true, 1200, "Wh", true, 1.2, "kWh"},
+		{"humidity", "40", "%", true, 40, "%", true, 40, "%"},
+		{"temperature", "warm", "c", false, 0, "", false, 0, ""},
+		{"temperature", "nan", "c", false, 0, "", false, 0, ""},
+		{"switch", "1", "", false, 0, "", false, 0, ""},
+	}
+	for _, tt := range tests {
+		e := event{Name: tt.name, Value: tt.value, Unit: tt.unit}
+		e.setNumericValue()
+		if (e.NumericValue != nil) != tt.numeric || (tt.numeric && (*e.NumericValue != tt.numericValue || e.NumericUnit != tt.numericUnit)) {
+			t.Errorf("%s %q %q: numeric value %v %q", tt.name, tt.value, tt.unit, e.NumericValue, e.NumericUnit)
+		}
+		if (e.CanonicalValue != nil) != tt.canonical || (tt.canonical && (*e.CanonicalValue != tt.canonicalValue || e.CanonicalUnit != tt.canonicalUnit)) {
+			t.Errorf("%s %q %q: canonical value %v %q", tt.name, tt.value, tt.unit, e.CanonicalValue, e.CanonicalUnit)
+		}
+	}
+}
+
+func TestParseBound(t *testing.T) {
+	tests := []struct {
+		arg, unit, canonical string
+		want                 string
+		ok                   bool
+	}{
+		{"", "", "C", "", true},
+		{"30", "", "C", "30", true},
+		{"86", "F", "C", "30", true},
+		{"2", "kW", "W", "2000", true},
+		{"2", "kW", "C", "", false},
+		{"warm", "", "C", "", false},
+		{"inf", "", "C", "", false},
+	}
+	for _, tt := range tests {
+		got, err := parseBound(tt.arg, tt.unit, tt.canonical)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseBound(%q, %q, %q) = %q, %v", tt.arg, tt.unit, tt.canonical, got, err)
+		}
+	}
+}
+
+func TestWithOutputUnit(t *testing.T) {
+	tests := []struct {
+		name    string
+		results string
+		unit    string
+		want    string
+	}{
+		{"no unit", `[{"Key":"k","Record":{"name":"temperature","value":"22","unit":"c"}}]`, "",
+			`[{"Key":"k","Record":{"name":"temperature","value":"22","unit":"c"}}]`},
+		{"stored value", `[{"Key":"k","Record":{"name":"temperature","value":"22","unit":"c","numericValue":22,"numericUnit":"C"}}]`, "F",
+			`[{"Key":"k","Record":{"convertedUnit":"F","convertedValue":71.6,"name":"temperature","numericUnit":"C","numericValue":22,"unit":"c","value":"22"}}]`},
+		{"parsed on the fly", `[{"Key":"k","Record":{"name":"power","value":"1.5","unit":"kw"}}]`, "W",
+			`[{"Key":"k","Record":{"convertedUnit":"W","convertedValue":1500,"name":"power","unit":"kw","value":"1.5"}}]`},
+		{"other quantity", `[{"Key":"k","Record":{"name":"power","value":"1.5","unit":"kw"}}]`, "C",
+			`[{"Key":"k","Record":{"name":"power","unit":"kw","value":"1.5"}}]`},
+		{"summary", `[{"Key":"k","Record":{"docType":"HourlySummary","name":"temperature","unit":"C","last":"22"}}]`, "F",
+			`[{"Key":"k","Record":{"docType":"HourlySummary","last":"22","name":"temperature","unit":"C"}}]`},
+		{"page", `{"Records":[{"Key":"k","Record":{"name":"energy","value":"1200","unit":"wh"}}],"ResponseMetadata":{"bookmark":"b"}}`, "kWh",
+			`{"Records":[{"Key":"k","Record":{"convertedUnit":"kWh","convertedValue":1.2,"name":"energy","unit":"wh","value":"1200"}}],"ResponseMetadata":{"bookmark":"b"}}`},
+	}
+	for _, tt := range tests {
+		got, err := withOutputUnit([]byte(tt.results), tt.unit)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: withOutputUnit() = %s, %v\nwant %s", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Package verifier checks the inclusion proofs returned by the chaincode's
+// getInclusionProof function offline, without access to the ledger.
+//
+// A proof shows that an event was part of the events a location logged on
+// a day when the day was sealed with sealDay. Verify recomputes the day's
+// Merkle root from the event record and the sibling hashes; the caller
+// still has to compare the root with the one stored by the sealDay
+// transaction (SealTxID) on the ledger.
+package verifier
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Hash prefixes, which must match the chaincode's merkle.go.
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// Step is one sibling on the path from a leaf to the root. Left is set
+// when the sibling is the left child.
+type Step struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// Proof is the JSON returned by getInclusionProof.
+type Proof struct {
+	LocationID string `json:"locationId"`
+	Date       string `json:"date"`
+	EventKey   string `json:"eventKey"`
+	Record     string `json:"record"`
+	Leaf       string `json:"leaf"`
+	Index      int    `json:"index"`
+	Leaves     int    `json:"leaves"`
+	Siblings   []Step `json:"siblings"`
+	Root       string `json:"root"`
+	SealTxID   string `json:"sealTxId"`
+}
+
+// Parse reads a proof from its JSON.
+func Parse(data []byte) (Proof, error) {
+	var p Proof
+	err := json.Unmarshal(data, &p)
+	return p, err
+}
+
+// LeafHash returns the leaf hash of an event record.
+func LeafHash(record []byte) []byte {
+	sum := sha256.Sum256(append([]byte{leafPrefix}, record...))
+	return sum[:]
+}
+
+// NodeHash returns the hash of an inner node from its children.
+func NodeHash(left, right []byte) []byte {
+	buf := append([]byte{nodePrefix}, left...)
+	sum := sha256.Sum256(append(buf, right...))
+	return sum[:]
+}
+
+// Verify checks that the proof's record hashes up to its root and that the
+// record belongs to the proof's location and day.
+func (p Proof) Verify() error {
+	var record struct {
+		LocationID string `json:"locationId"`
+		Date       string `json:"date"`
+	}
+	if err := json.Unmarshal([]byte(p.Record), &record); err != nil {
+		return fmt.Errorf("record is not an event: %v", err)
+	}
+	if record.LocationID != p.LocationID || record.Date != p.Date {
+		return errors.New("record is not from the proof's location and day")
+	}
+
+	hash := LeafHash([]byte(p.Record))
+	if p.Leaf != "" && p.Leaf != hex.EncodeToString(hash) {
+		return errors.New("leaf hash does not match the record")
+	}
+	for i, step := range p.Siblings {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil || len(sibling) != sha256.Size {
+			return fmt.Errorf("sibling %d is not a SHA-256 hash", i)
+		}
+		if step.Left {
+			hash = NodeHash(sibling, hash)
+		} else {
+			hash = NodeHash(hash, sibling)
+		}
+	}
+
+	root, err := hex.DecodeString(p.Root)
+	if err != nil {
+		return errors.New("root is not a hex hash")
+	}
+	if !bytes.Equal(hash, root) {
+		return errors.New("proof does not lead to the root")
+	}
+	return nil
+}
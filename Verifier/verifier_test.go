@@ -0,0 +1,51 @@
+package verifier
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	record := `{"docType":"Event","locationId":"loc1","date":"20180815"}`
+	other := LeafHash([]byte(`{"docType":"Event","locationId":"loc1","date":"20180815","n":1}`))
+	third := LeafHash([]byte(`{"docType":"Event","locationId":"loc1","date":"20180815","n":2}`))
+	leaf := LeafHash([]byte(record))
+	root := NodeHash(third, NodeHash(other, leaf))
+	valid := Proof{
+		LocationID: "loc1",
+		Date:       "20180815",
+		Record:     record,
+		Leaf:       hex.EncodeToString(leaf),
+		Siblings: []Step{
+			{Hash: hex.EncodeToString(other), Left: true},
+			{Hash: hex.EncodeToString(third), Left: true},
+		},
+		Root: hex.EncodeToString(root),
+	}
+
+	tests := []struct {
+		name   string
+		change func(p *Proof)
+		ok     bool
+	}{
+		{"valid", func(p *Proof) {}, true},
+		{"no leaf", func(p *Proof) { p.Leaf = "" }, true},
+		{"altered record", func(p *Proof) { p.Record = `{"docType":"Event","locationId":"loc1","date":"20180815","value":"x"}` }, false},
+		{"other location", func(p *Proof) { p.LocationID = "loc2" }, false},
+		{"other day", func(p *Proof) { p.Date = "20180816" }, false},
+		{"wrong leaf", func(p *Proof) { p.Leaf = hex.EncodeToString(other) }, false},
+		{"swapped sibling", func(p *Proof) { p.Siblings = []Step{{Hash: p.Siblings[0].Hash}, p.Siblings[1]} }, false},
+		{"short sibling", func(p *Proof) { p.Siblings = []Step{{Hash: "00"}, p.Siblings[1]} }, false},
+		{"missing sibling", func(p *Proof) { p.Siblings = p.Siblings[:1] }, false},
+		{"other root", func(p *Proof) { p.Root = hex.EncodeToString(leaf) }, false},
+		{"not an event", func(p *Proof) { p.Record = "[]" }, false},
+	}
+	for _, tt := range tests {
+		p := valid
+		p.Siblings = append([]Step(nil), valid.Siblings...)
+		tt.change(&p)
+		if err := p.Verify(); (err == nil) != tt.ok {
+			t.Errorf("%s: Verify() = %v", tt.name, err)
+		}
+	}
+}
@@ -86,6 +86,9 @@ preferences {
     section("Log these locks:") {
         input "locks", "capability.lock", multiple: true, required: false
     }
+    section("Log these batteries:") {
+        input "batteries", "capability.battery", multiple: true, required: false
+    }
     section() {
         input "appId", "text",
             title: "Xooa app ID:", submitOnChange: true
@@ -113,14 +116,14 @@ def initialize() {
 
 def doSubscriptions() {
     subscribe(alarms, "alarm", alarmHandler)
-    subscribe(codetectors, "carbonMonoxideDetector", coHandler)
+    subscribe(codetectors, "carbonMonoxide", coHandler)
     subscribe(contacts, "contact", contactHandler)
     subscribe(indicators, "indicator", indicatorHandler)
     subscribe(modes, "locationMode", modeHandler)
     subscribe(motions, "motion", motionHandler)
     subscribe(presences, "presence", presenceHandler)
     subscribe(relays, "relaySwitch", relayHandler)
-    subscribe(smokedetectors, "smokeDetector", smokeHandler)
+    subscribe(smokedetectors, "smoke", smokeHandler)
     subscribe(switches, "switch", switchHandler)
     subscribe(levels, "level", levelHandler)
     subscribe(temperatures, "temperature", temperatureHandler)
@@ -130,11 +133,10 @@ def doSubscriptions() {
     subscribe(powermeters, "power", powerHandler)
     subscribe(energymeters, "energy", energyHandler)
     subscribe(locks, "lock", lockHandler)
+    subscribe(batteries, "battery", batteryHandler)
 }
 
 def genericHandler(evt) {
-	def httpUrl = settings.appId // appId will constitute the URL request.
-    def bearer = settings.apiToken // bearer will be passed in header as authorisation for the request to Xooa blockchain platform
 /*
     log.debug("------------------------------")
     log.debug("date: ${evt.date}")
@@ -176,6 +178,17 @@ def genericHandler(evt) {
     json += "\"${evt.name}\","
     json += "\"${evt.isoDate}\""
     json += "]}"
+    postEvent([body: json, attempt: 1])
+}
+
+// Events of one device saved in the same block conflict on the device's
+// hash chain, and all but the first fail with MVCC_READ_CONFLICT. Those are
+// posted again after a pause, up to maxAttempts times.
+def maxAttempts() { 5 }
+
+def postEvent(data) {
+	def httpUrl = settings.appId // appId will constitute the URL request.
+    def bearer = settings.apiToken // bearer will be passed in header as authorisation for the request to Xooa blockchain platform
     // saveNewEvent() function present in chaincode is called in this request. 
     // Modify the endpoint of this URL accordingly if function name is changed
     // Modify the json parameter sent in this request if definition of the function is changed in the chaincode
@@ -185,13 +198,18 @@ def genericHandler(evt) {
             "Authorization": "Bearer ${bearer}",
             "content-type": "application/json"
         ],
-        body: json
+        body: data.body
     ]
     log.debug("Params: ${params}")
     try {
         httpPostJson(params)
     } catch (groovyx.net.http.HttpResponseException ex) {
         if (ex.statusCode < 200 || ex.statusCode >= 300) {
+            if ("${ex.response?.data}".contains("MVCC_READ_CONFLICT") && data.attempt < maxAttempts()) {
+                log.debug "Event conflicted with another of its device, posting it again (attempt ${data.attempt + 1})"
+                runIn(data.attempt * 2, postEvent, [data: [body: data.body, attempt: data.attempt + 1], overwrite: false])
+                return
+            }
             log.debug "Unexpected response error: ${ex.statusCode}"
             log.debug ex
             log.debug ex.response.contentType
@@ -269,4 +287,8 @@ def energyHandler(evt) {
 
 def lockHandler(evt) {
 	genericHandler(evt)
+}
+
+def batteryHandler(evt) {
+	genericHandler(evt)
 }
\ No newline at end of file